@@ -3,7 +3,9 @@ package pooly
 import (
 	"math"
 	"math/rand"
+	"sort"
 	"sync"
+	"time"
 )
 
 // SoftMax strategy varies host selection probabilities as a graded function of their estimated scores.
@@ -19,32 +21,51 @@ func NewSoftMax(temperature float32) *SoftMax {
 	return &SoftMax{temperature}
 }
 
+type softMaxWeight struct {
+	host *Host
+	exp  float64
+}
+
+// Scratch buffers reused across SoftMax selections to spare an allocation per call.
+var softMaxScratch = sync.Pool{
+	New: func() interface{} { return new([]softMaxWeight) },
+}
+
 // Select implements the Selecter interface.
-func (s *SoftMax) Select(hosts map[string]*Host) *Host {
+func (s *SoftMax) Select(hosts map[string]*Host) (host *Host) {
 	var sum, prob float64
-	exp := make(map[*Host]float64, len(hosts))
+
+	buf := softMaxScratch.Get().(*[]softMaxWeight)
+	weights := (*buf)[:0]
 
 	for _, h := range hosts {
-		score := h.Score()
-		if score < 0 { // no score recorded
-			exp[h] = 0
-			continue
+		w := softMaxWeight{host: h}
+		if score := h.Score(); score >= 0 { // score recorded
+			w.exp = math.Exp(score / float64(s.temperature))
 		}
-		exp[h] = math.Exp(score / float64(s.temperature))
-		sum += exp[h]
+		sum += w.exp
+		weights = append(weights, w)
 	}
 
 	p := rand.Float64()
-	for _, h := range hosts {
+	for _, w := range weights {
 		if sum == 0 {
-			return h
+			host = w.host
+			break
 		}
-		prob += exp[h] / sum // cumulative probability
+		prob += w.exp / sum // cumulative probability
 		if prob > p {
-			return h
+			host = w.host
+			break
 		}
 	}
-	return nil
+
+	for i := range weights {
+		weights[i].host = nil // don't retain hosts in the pool
+	}
+	*buf = weights
+	softMaxScratch.Put(buf)
+	return
 }
 
 // EpsilonGreedy strategy selects generally the host having the highest score (greedy) but every once in a while
@@ -83,10 +104,12 @@ func (e *EpsilonGreedy) Select(hosts map[string]*Host) (host *Host) {
 }
 
 // RoundRobin strategy selects hosts in circular manner with every request returning the next host in line.
+// Hosts are scheduled in lexicographic order of their address when they join the rotation together.
 type RoundRobin struct {
 	sync.Mutex
 	nextSchedule  int64
 	nextAvailSlot int64
+	reset         bool
 }
 
 // NewRoundRobin creates a new RoundRobin bandit strategy.
@@ -94,6 +117,32 @@ func NewRoundRobin() *RoundRobin {
 	return new(RoundRobin)
 }
 
+// Reset resets the rotation, the next selection returns the first host in lexicographic order.
+func (r *RoundRobin) Reset() {
+	r.Lock()
+	r.nextSchedule = 0
+	r.nextAvailSlot = 0
+	r.reset = true
+	r.Unlock()
+}
+
+// Attribute schedules to the hosts joining the rotation.
+func (r *RoundRobin) schedule(hosts map[string]*Host) {
+	var addrs []string
+
+	for a, h := range hosts {
+		if r.reset || h.score < 0 { // no score recorded
+			addrs = append(addrs, a)
+		}
+	}
+	r.reset = false
+	sort.Strings(addrs)
+	for _, a := range addrs {
+		hosts[a].score = float64(r.nextAvailSlot)
+		r.nextAvailSlot++
+	}
+}
+
 // Select implements the Selecter interface.
 func (r *RoundRobin) Select(hosts map[string]*Host) (host *Host) {
 	var offset int64
@@ -102,11 +151,8 @@ func (r *RoundRobin) Select(hosts map[string]*Host) (host *Host) {
 	// XXX score is not used, use it to attribute round robin scheduling instead
 	// we don't need proper synchronization since score memoization isn't running here
 	r.Lock()
+	r.schedule(hosts)
 	for _, h := range hosts {
-		if h.score < 0 { // no score recorded
-			h.score = float64(r.nextAvailSlot)
-			r.nextAvailSlot++
-		}
 		if int64(h.score) == r.nextSchedule {
 			offset = 1
 			host = h
@@ -128,3 +174,65 @@ func (r *RoundRobin) Select(hosts map[string]*Host) (host *Host) {
 	r.Unlock()
 	return
 }
+
+// WeightedSelecter associates a bandit strategy with its weight in an Ensemble.
+type WeightedSelecter struct {
+	Selecter Selecter
+	Weight   float64
+}
+
+// Ensemble strategy blends several bandit strategies, delegating every selection to one of them
+// chosen randomly in proportion to its weight (e.g 80% SoftMax, 20% EpsilonGreedy).
+// This allows to roll out a new strategy alongside a trusted one.
+// Note that RoundRobin can not be part of an ensemble since it relies on hosts scores not being computed.
+type Ensemble struct {
+	sync.Mutex
+	strategies []WeightedSelecter
+	total      float64
+	rand       *rand.Rand
+}
+
+// NewEnsemble creates a new Ensemble bandit strategy.
+// Strategies with a non-positive weight are never selected.
+// It returns ErrInvalidArg if one of the strategies is a RoundRobin, whatever its weight.
+func NewEnsemble(strategies ...WeightedSelecter) (*Ensemble, error) {
+	e := &Ensemble{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, s := range strategies {
+		if _, ok := s.Selecter.(*RoundRobin); ok {
+			return nil, ErrInvalidArg
+		}
+		if s.Weight > 0 {
+			e.strategies = append(e.strategies, s)
+			e.total += s.Weight
+		}
+	}
+	return e, nil
+}
+
+// Seed seeds the random source used to pick strategies, making selections deterministic.
+func (e *Ensemble) Seed(seed int64) {
+	e.Lock()
+	e.rand.Seed(seed)
+	e.Unlock()
+}
+
+// Select implements the Selecter interface.
+func (e *Ensemble) Select(hosts map[string]*Host) *Host {
+	var sum float64
+
+	if len(e.strategies) == 0 {
+		return nil
+	}
+
+	e.Lock()
+	p := e.rand.Float64() * e.total
+	e.Unlock()
+
+	for _, s := range e.strategies {
+		sum += s.Weight
+		if sum > p {
+			return s.Selecter.Select(hosts)
+		}
+	}
+	return e.strategies[len(e.strategies)-1].Selecter.Select(hosts)
+}
@@ -0,0 +1,108 @@
+package pooly
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func newScoredHosts(scores ...float64) map[string]*Host {
+	hosts := make(map[string]*Host, len(scores))
+	for i, s := range scores {
+		hosts[strconv.Itoa(i)] = &Host{score: s}
+	}
+	return hosts
+}
+
+func TestSoftMaxDistribution(t *testing.T) {
+	const n = 100000
+
+	hosts := newScoredHosts(0.9, 0.5, 0.1, -1)
+	s := NewSoftMax(0.2)
+
+	var sum float64
+	expected := make(map[*Host]float64, len(hosts))
+	for _, h := range hosts {
+		if h.score >= 0 {
+			expected[h] = math.Exp(h.score / 0.2)
+		}
+		sum += expected[h]
+	}
+
+	count := make(map[*Host]int, len(hosts))
+	for i := 0; i < n; i++ {
+		count[s.Select(hosts)]++
+	}
+	for _, h := range hosts {
+		p := float64(count[h]) / n
+		if math.Abs(p-expected[h]/sum) > 0.01 {
+			t.Fatalf("host scored %v: probability %v, expected %v", h.score, p, expected[h]/sum)
+		}
+	}
+}
+
+func TestSoftMaxNoScore(t *testing.T) {
+	hosts := newScoredHosts(-1, -1)
+
+	if NewSoftMax(0.2).Select(hosts) == nil {
+		t.Fatal("host expected")
+	}
+}
+
+func BenchmarkSoftMaxSelect(b *testing.B) {
+	hosts := newScoredHosts(0.9, 0.8, 0.7, 0.6, 0.5, 0.4, 0.3, 0.2, 0.1, 0)
+	s := NewSoftMax(0.2)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.Select(hosts)
+	}
+}
+
+type countingSelecter int
+
+func (c *countingSelecter) Select(hosts map[string]*Host) *Host {
+	*c++
+	for _, h := range hosts {
+		return h
+	}
+	return nil
+}
+
+func TestEnsembleDistribution(t *testing.T) {
+	const n = 10000
+
+	var a, b countingSelecter
+	hosts := newScoredHosts(0.5)
+
+	e, err := NewEnsemble(
+		WeightedSelecter{&a, 0.8},
+		WeightedSelecter{&b, 0.2},
+		WeightedSelecter{&b, 0},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Seed(42)
+
+	for i := 0; i < n; i++ {
+		if e.Select(hosts) == nil {
+			t.Fatal("host expected")
+		}
+	}
+	if a+b != n {
+		t.Fatal("selections delegated to weighted strategies only expected")
+	}
+	if p := float64(a) / n; math.Abs(p-0.8) > 0.02 {
+		t.Fatal("80% of selections expected, got", p)
+	}
+}
+
+func TestEnsembleRoundRobin(t *testing.T) {
+	var a countingSelecter
+
+	_, err := NewEnsemble(WeightedSelecter{&a, 1}, WeightedSelecter{NewRoundRobin(), 0})
+	if err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+}
@@ -0,0 +1,101 @@
+package pooly
+
+import "time"
+
+// PoolBuilder helps building pools with complex configurations.
+// Options are set through its With methods and checked upon Build.
+type PoolBuilder struct {
+	config   PoolConfig
+	minConns int32
+}
+
+// NewPoolBuilder creates a new pool builder, using the defaults values unless specified otherwise.
+func NewPoolBuilder() *PoolBuilder {
+	return new(PoolBuilder)
+}
+
+// WithDriver sets the connection driver (see PoolConfig.Driver).
+func (b *PoolBuilder) WithDriver(d Driver) *PoolBuilder {
+	b.config.Driver = d
+	return b
+}
+
+// WithMaxConns sets the maximum number of connections allowed in the pool (see PoolConfig.MaxConns).
+func (b *PoolBuilder) WithMaxConns(n int32) *PoolBuilder {
+	b.config.MaxConns = n
+	return b
+}
+
+// WithMinConns sets the number of connections spawned when the pool is built (none by default).
+func (b *PoolBuilder) WithMinConns(n int32) *PoolBuilder {
+	b.minConns = n
+	return b
+}
+
+// WithIdleTimeout sets the duration after which idle connections are closed (see PoolConfig.ConnIdleTimeout).
+func (b *PoolBuilder) WithIdleTimeout(d time.Duration) *PoolBuilder {
+	b.config.ConnIdleTimeout = d
+	return b
+}
+
+// WithWaitTimeout sets the duration during which Get operations wait for a connection (see PoolConfig.WaitTimeout).
+func (b *PoolBuilder) WithWaitTimeout(d time.Duration) *PoolBuilder {
+	b.config.WaitTimeout = d
+	return b
+}
+
+// WithConnRetries sets the number of connection retry (see PoolConfig.ConnRetries).
+func (b *PoolBuilder) WithConnRetries(n int) *PoolBuilder {
+	b.config.ConnRetries = n
+	return b
+}
+
+// WithRetryDelay sets the time interval between connection retry (see PoolConfig.RetryDelay).
+func (b *PoolBuilder) WithRetryDelay(d time.Duration) *PoolBuilder {
+	b.config.RetryDelay = d
+	return b
+}
+
+// WithPprofLabels enables pprof labels on the pool routines (see PoolConfig.EnablePprofLabels).
+func (b *PoolBuilder) WithPprofLabels(enable bool) *PoolBuilder {
+	b.config.EnablePprofLabels = enable
+	return b
+}
+
+func (b *PoolBuilder) validate(address string) error {
+	c := &b.config
+
+	if address == "" {
+		return ErrInvalidArg
+	}
+	if c.MaxConns < 0 || b.minConns < 0 || c.ConnRetries < 0 {
+		return ErrInvalidArg
+	}
+	if c.ConnIdleTimeout < 0 || c.WaitTimeout < 0 || c.RetryDelay < 0 {
+		return ErrInvalidArg
+	}
+
+	max := c.MaxConns
+	if max == 0 {
+		max = DefaultMaxConns
+	}
+	if b.minConns > max {
+		return ErrInvalidArg
+	}
+	return nil
+}
+
+// Build creates a new pool bound to the given address, using the configuration built so far.
+// It returns ErrInvalidArg if the address is missing or if the options are invalid or mutually incompatible.
+func (b *PoolBuilder) Build(address string) (*Pool, error) {
+	if err := b.validate(address); err != nil {
+		return nil, err
+	}
+
+	c := b.config // the builder can be reused
+	p := NewPool(address, &c)
+	if b.minConns > 0 {
+		p.New(uint(b.minConns))
+	}
+	return p, nil
+}
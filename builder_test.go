@@ -0,0 +1,53 @@
+package pooly
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoolBuilder(t *testing.T) {
+	p, err := NewPoolBuilder().
+		WithDriver(nopDriver{}).
+		WithMaxConns(2).
+		WithMinConns(2).
+		WithIdleTimeout(1 * time.Second).
+		Build(echo1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.MaxConns != 2 || p.ConnIdleTimeout != 1*time.Second {
+		t.Fatal("bad configuration:", p.PoolConfig)
+	}
+	if _, ok := p.Driver.(nopDriver); !ok {
+		t.Fatal("nop driver expected")
+	}
+	time.Sleep(1 * time.Millisecond) // wait for connections to be spawned
+	if p.ActiveConns() != 2 {
+		t.Fatal("2 connections spawned expected")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolBuilderValidation(t *testing.T) {
+	builders := map[string]*PoolBuilder{
+		"no address":        NewPoolBuilder(),
+		"negative maxconns": NewPoolBuilder().WithMaxConns(-1),
+		"negative retries":  NewPoolBuilder().WithConnRetries(-1),
+		"negative timeout":  NewPoolBuilder().WithWaitTimeout(-1),
+		"minconns > max":    NewPoolBuilder().WithMaxConns(2).WithMinConns(3),
+		"minconns > dflt":   NewPoolBuilder().WithMinConns(DefaultMaxConns + 1),
+	}
+	for name, b := range builders {
+		address := echo1
+		if name == "no address" {
+			address = ""
+		}
+		if _, err := b.Build(address); err != ErrInvalidArg {
+			t.Fatal(name, ": invalid argument expected")
+		}
+	}
+}
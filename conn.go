@@ -1,18 +1,37 @@
 package pooly
 
 import (
+	"math"
 	"net"
 	"time"
 )
 
 // Conn abstracts user connections that are part of a Pool.
 type Conn struct {
-	iface     interface{}
-	timer     *time.Timer
-	timerStop chan bool
-	closed    bool
-	host      *Host
-	gottenAt  time.Time
+	id          uint64
+	iface       interface{}
+	timer       *time.Timer
+	timerStop   chan bool
+	idleTimeout time.Duration
+	closed      bool
+	borrowed    bool
+	reused      bool
+	burst       bool
+	driver      Driver
+	address     string
+	tags        uint64
+	tested      bool
+	testErr     error
+	deadline    bool
+	listed      bool  // guarded by the pool idle list
+	prev        *Conn // previous connection in the pool idle list
+	next        *Conn // next connection in the pool idle list
+	measured    *MeasuredConn
+	pool        *Pool
+	host        *Host
+	createdAt   time.Time
+	gottenAt    time.Time
+	idleSince   time.Time
 }
 
 // NewConn creates a new connection container, wrapping up a user defined connection object.
@@ -20,20 +39,142 @@ func NewConn(i interface{}) *Conn {
 	return &Conn{
 		iface:     i,
 		timerStop: make(chan bool),
+		createdAt: time.Now(),
 	}
 }
 
+// ID returns the identifier of the connection, unique within the pool it belongs to
+// (within the service for connections obtained from a Service).
+// IDs are assigned incrementally by the pool when the connection is spawned, 0 means it was never part of a pool.
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// SetTags tags the connection with a set of flags (e.g. capabilities negotiated by the driver on Dial).
+func (c *Conn) SetTags(tags uint64) {
+	c.tags = tags
+}
+
+// Tags returns the flags the connection was tagged with.
+func (c *Conn) Tags() uint64 {
+	return c.tags
+}
+
+// HasTags returns true if the connection is tagged with all the given flags.
+func (c *Conn) HasTags(tags uint64) bool {
+	return c.tags&tags == tags
+}
+
 // Interface returns an interface referring to the underlying user object.
 func (c *Conn) Interface() interface{} {
 	return c.iface
 }
 
-// NetConn is a helper for underlying user objects that satisfy the standard library net.Conn interface.
+// NetConn is a helper for underlying user objects that satisfy the standard library net.Conn interface,
+// or wrap one and expose it through an Unwrap() net.Conn method.
+// It returns nil if the underlying user object is neither.
 func (c *Conn) NetConn() net.Conn {
-	if c.iface == nil {
+	switch v := c.iface.(type) {
+	case net.Conn:
+		return v
+	case interface{ Unwrap() net.Conn }:
+		return v.Unwrap()
+	}
+	return nil
+}
+
+// Read reads data from the underlying net.Conn (see NetConn).
+// It returns ErrNotNetConn if the underlying user object is not a net.Conn.
+func (c *Conn) Read(b []byte) (int, error) {
+	nc := c.NetConn()
+	if nc == nil {
+		return 0, ErrNotNetConn
+	}
+	return nc.Read(b)
+}
+
+// Write writes data to the underlying net.Conn (see NetConn).
+// It returns ErrNotNetConn if the underlying user object is not a net.Conn.
+func (c *Conn) Write(b []byte) (int, error) {
+	nc := c.NetConn()
+	if nc == nil {
+		return 0, ErrNotNetConn
+	}
+	return nc.Write(b)
+}
+
+// Close closes the underlying net.Conn (see NetConn), this allows the connection to be used as a net.Conn.
+// The connection must still be released afterwards, with a fatal error so that it gets garbage collected.
+// It returns ErrNotNetConn if the underlying user object is not a net.Conn.
+func (c *Conn) Close() error {
+	nc := c.NetConn()
+	if nc == nil {
+		return ErrNotNetConn
+	}
+	return nc.Close()
+}
+
+// LocalAddr returns the local address of the underlying net.Conn (see NetConn), nil if there is none.
+func (c *Conn) LocalAddr() net.Addr {
+	nc := c.NetConn()
+	if nc == nil {
 		return nil
 	}
-	return c.iface.(net.Conn)
+	return nc.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying net.Conn (see NetConn), nil if there is none.
+func (c *Conn) RemoteAddr() net.Addr {
+	nc := c.NetConn()
+	if nc == nil {
+		return nil
+	}
+	return nc.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the underlying net.Conn (see NetConn).
+// It returns ErrNotNetConn if the underlying user object is not a net.Conn.
+func (c *Conn) SetDeadline(t time.Time) error {
+	nc := c.NetConn()
+	if nc == nil {
+		return ErrNotNetConn
+	}
+	return nc.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying net.Conn (see NetConn).
+// It returns ErrNotNetConn if the underlying user object is not a net.Conn.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	nc := c.NetConn()
+	if nc == nil {
+		return ErrNotNetConn
+	}
+	return nc.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying net.Conn (see NetConn).
+// It returns ErrNotNetConn if the underlying user object is not a net.Conn.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	nc := c.NetConn()
+	if nc == nil {
+		return ErrNotNetConn
+	}
+	return nc.SetWriteDeadline(t)
+}
+
+// Driver returns the driver the connection was created with, from the pool it belongs to.
+// It returns nil if the connection is not currently checked out from a pool (e.g. after Release).
+func (c *Conn) Driver() Driver {
+	if c.pool == nil || !c.borrowed {
+		return nil
+	}
+	return c.pool.driverOf(c)
+}
+
+// SetIdleTimeout overrides the pool ConnIdleTimeout for this connection (e.g. following a server-announced limit).
+// It is typically called by drivers and takes effect the next time the connection is returned to the pool.
+func (c *Conn) SetIdleTimeout(d time.Duration) {
+	c.idleTimeout = d
 }
 
 func (c *Conn) isClosed() bool {
@@ -49,20 +190,35 @@ func (c *Conn) setClosed() {
 	c.closed = true
 }
 
-func (c *Conn) setIdle(p *Pool) {
-	if p.ConnIdleTimeout > 0 {
-		c.timer = time.NewTimer(p.ConnIdleTimeout)
-		go func() {
-			select {
-			case <-c.timerStop:
-				return
-			case <-c.timer.C:
-				// The connection has been idle for too long,
-				// send it to the garbage collector
-				p.gc <- c
-			}
-		}()
+// Arms the idle timer of the connection, it returns false if the connection never times out.
+func (c *Conn) setIdle(p *Pool) bool {
+	d := p.ConnIdleTimeout
+	if c.idleTimeout > 0 {
+		d = c.idleTimeout
+	}
+	if d <= 0 {
+		return false
 	}
+	if p.FixedIdle {
+		d -= time.Since(c.createdAt)
+	}
+	c.timer = time.NewTimer(d)
+	return true
+}
+
+// Watches the idle timer armed by setIdle.
+func (c *Conn) watchIdle(p *Pool) {
+	t := c.timer
+	go p.do("idle-timer", func() {
+		select {
+		case <-c.timerStop:
+			return
+		case <-t.C:
+			// The connection has been idle for too long,
+			// send it to the garbage collector
+			p.gc <- c
+		}
+	})
 }
 
 func (c *Conn) setActive() bool {
@@ -75,6 +231,10 @@ func (c *Conn) setActive() bool {
 	return true
 }
 
+func (c *Conn) setPool(p *Pool) {
+	c.pool = p
+}
+
 func (c *Conn) setHost(h *Host) {
 	c.host = h
 }
@@ -92,29 +252,46 @@ func (c *Conn) diffTime() time.Duration {
 // a score between 0 and 1 which describes how well the connection performed (e.g inverse response time, up/down ...).
 // If the error state indicates a fatal error (determined by Driver.Temporary), the score is forced to the value 0 (HostDown).
 func (c *Conn) Release(err interface{}, score float64) error {
+	return c.release(err, score, 1)
+}
+
+// ReleaseWeighted is like Release but the score counts as weight observations (e.g. for a connection
+// having served a batch of operations), so that high-volume borrows influence the host score proportionally.
+func (c *Conn) ReleaseWeighted(err interface{}, score float64, weight uint) error {
+	if weight == 0 || weight > math.MaxUint32 {
+		return ErrInvalidArg
+	}
+	return c.release(err, score, uint32(weight))
+}
+
+func (c *Conn) release(err interface{}, score float64, weight uint32) error {
 	var e error
 
-	if c.host == nil {
+	h := c.host
+	if h == nil {
 		return ErrNoHostAvailable
 	}
 	if score < 0 || score > 1 {
 		return ErrInvalidArg
 	}
 
-	switch v := err.(type) {
-	case error:
-		e = v
-	case *error:
-		e = *v
-	case nil:
-		e = nil
-	default:
-		return ErrInvalidArg
+	if err != nil { // fast path otherwise, nothing to convert
+		switch v := err.(type) {
+		case error:
+			e = v
+		case *error:
+			e = *v
+		default:
+			return ErrInvalidArg
+		}
 	}
 
-	h := c.host
+	if c.deadline { // applied from a context (see ServiceConfig.ApplyContextDeadline)
+		c.SetDeadline(time.Time{})
+		c.deadline = false
+	}
 	c.host = nil
-	return h.releaseConn(c, e, score)
+	return h.releaseConn(c, e, score, weight)
 }
 
 // Address returns the address of the host bound to the connection.
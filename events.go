@@ -0,0 +1,69 @@
+package pooly
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PoolEventType defines the type of a pool event.
+type PoolEventType int
+
+// Pool event types.
+const (
+	// A new connection has been established (or transferred from another pool, see Pool.TransferTo).
+	ConnDialed PoolEventType = iota
+	// A connection has been closed (garbage collected).
+	ConnClosed
+	// Get had to wait for a connection to become available.
+	GetWaited
+	// Get timed out waiting for a connection (see PoolConfig.WaitTimeout).
+	GetTimedOut
+	// No connection was available and MaxConns was reached.
+	Saturated
+	// A connection has been checked out from the pool.
+	ConnCheckedOut
+	// A connection has been put back into the pool.
+	ConnReturned
+)
+
+// Size of the pool events buffer.
+const eventsBufferSize = 64
+
+// PoolEvent describes an event which occurred in a pool (see Pool.Events).
+type PoolEvent struct {
+	Type PoolEventType
+
+	// Time at which the event occurred.
+	At time.Time
+
+	// Time spent waiting for a connection (GetWaited and GetTimedOut only).
+	Wait time.Duration
+
+	// Connection concerned (ConnDialed, ConnClosed, ConnCheckedOut and ConnReturned only).
+	Conn *Conn
+}
+
+type eventStream struct {
+	on int32
+	c  chan PoolEvent
+}
+
+func newEventStream() eventStream {
+	return eventStream{c: make(chan PoolEvent, eventsBufferSize)}
+}
+
+func (s *eventStream) subscribe() <-chan PoolEvent {
+	atomic.StoreInt32(&s.on, 1)
+	return s.c
+}
+
+// Emit an event without ever blocking, events are dropped if the consumer falls behind.
+func (s *eventStream) emit(t PoolEventType, c *Conn, wait time.Duration) {
+	if atomic.LoadInt32(&s.on) == 0 {
+		return // nobody is listening
+	}
+	select {
+	case s.c <- PoolEvent{Type: t, At: time.Now(), Wait: wait, Conn: c}:
+	default:
+	}
+}
@@ -16,14 +16,25 @@ const (
 	DefaultCloseDeadline        = 30 * time.Second
 	DefaultDecayDuration        = 1 * time.Minute
 	DefaultMemoizeScoreDuration = 100 * time.Millisecond
+	DefaultReconnectBackoff     = 100 * time.Millisecond
+	DefaultFailureThreshold     = 0.5
+	DefaultNeutralScore         = 0.5
+	DefaultHTTPClientErrorScore = 0.7
 )
 
 // Pooly global errors.
 var (
-	ErrInvalidArg      = errors.New("pooly: invalid argument")
-	ErrPoolClosed      = errors.New("pooly: pool is closed")
-	ErrOpTimeout       = errors.New("pooly: operation timed out")
-	ErrNoHostAvailable = errors.New("pooly: no host available")
+	ErrInvalidArg         = errors.New("pooly: invalid argument")
+	ErrPoolClosed         = errors.New("pooly: pool is closed")
+	ErrOpTimeout          = errors.New("pooly: operation timed out")
+	ErrNoHostAvailable    = errors.New("pooly: no host available")
+	ErrMaxHostsReached    = errors.New("pooly: maximum number of hosts reached")
+	ErrNoMatchingConn     = errors.New("pooly: no matching connection")
+	ErrCanceled           = errors.New("pooly: operation canceled")
+	ErrPartialAcquisition = errors.New("pooly: partial connection acquisition")
+	ErrPoolExhausted      = errors.New("pooly: pool is exhausted")
+	ErrNotNetConn         = errors.New("pooly: not a net.Conn")
+	ErrHostNotFound       = errors.New("pooly: host not found")
 )
 
 // statsd sample rate in percentage
@@ -2,7 +2,10 @@ package pooly
 
 import (
 	"github.com/cactus/go-statsd-client/statsd"
+	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Predefined scores (all or nothing).
@@ -13,25 +16,75 @@ const (
 
 const seriesNum = 60
 
+// Checkout durations are bucketed by half powers of two of microseconds (up to ~70 minutes).
+const (
+	histBuckets = 64
+	histDecay   = 0.5
+)
+
 type serie struct {
 	score  float64
 	trials uint32
 }
 
+// Decaying histogram of durations.
+type histogram [histBuckets]float64
+
 // Host defines a remote peer, usually referred by an address.
 type Host struct {
+	// XXX counters must be 64-bit aligned for atomic operations, keep them first
+	selections uint64
+
 	sync.RWMutex
 	pool       *Pool
 	timeSeries []serie
 	timeSlot   int
 	score      float64
+	scoredAt   time.Time
+	decayedAt  time.Time
+	memoized   bool
+	neutral    float64
+	floor      float64
 	stats      statsd.Statter
+	quit       chan struct{}
+	checkouts  histogram
+	inflight   *inFlightTracker
+	tags       map[string]string // guarded by the service lock
+	next       *Host             // copy superseding the host (see clone)
 }
 
-// Update the arithmetic mean of the series with a given score [0,1].
-func (s *serie) update(score float64) {
-	s.trials++
-	s.score = s.score + (score-s.score)/float64(s.trials)
+// HostStats describes the state of a host at a given time.
+type HostStats struct {
+	// Actual score of the host, -1 if it hasn't been computed yet, has been invalidated or if the service
+	// BanditStrategy doesn't compute scores (e.g. RoundRobin).
+	// Unlike Host.Score, scores below the service HostScoreFloor are reported as is rather than raised to the floor.
+	Score float64
+
+	// Time elapsed since the score was last computed or invalidated.
+	ScoreAge time.Duration
+
+	// Percentiles of the time connections were held before being released.
+	// Recent checkouts weigh more, older ones decay along with the host time series.
+	// Values are upper bounds accurate within a factor of sqrt(2), zero if nothing was recorded.
+	CheckoutP50 time.Duration
+	CheckoutP90 time.Duration
+	CheckoutP99 time.Duration
+
+	// Number of goroutines waiting for a connection from the host pool (see Pool.Waiters).
+	Waiters int
+}
+
+// Update the arithmetic mean of the series with a given score [0,1], observed n times.
+// The number of trials saturates rather than wrapping around, further observations are then ignored.
+func (s *serie) update(score float64, n uint32) {
+	if m := math.MaxUint32 - s.trials; n > m {
+		n = m
+	}
+	if n == 0 {
+		return
+	}
+	s.trials += n
+	s.score = s.score + (score-s.score)*float64(n)/float64(s.trials)
 }
 
 func (s *serie) reset() {
@@ -39,6 +92,42 @@ func (s *serie) reset() {
 	s.trials = 0
 }
 
+func (d *histogram) add(t time.Duration) {
+	i := 0
+	if us := float64(t / time.Microsecond); us >= 1 {
+		i = int(2*math.Log2(us)) + 1
+	}
+	if i >= histBuckets {
+		i = histBuckets - 1
+	}
+	d[i]++
+}
+
+func (d *histogram) decay() {
+	for i := range d {
+		d[i] *= histDecay
+	}
+}
+
+// Returns the upper bound of the bucket holding the p-th percentile [0,1].
+func (d *histogram) percentile(p float64) time.Duration {
+	var total, n float64
+
+	for _, c := range d {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	for i, c := range d {
+		n += c
+		if n >= p*total {
+			return time.Duration(math.Pow(2, float64(i)/2)) * time.Microsecond
+		}
+	}
+	return 0
+}
+
 func (h *Host) computeScore(c Computer) {
 	var score float64
 
@@ -56,56 +145,255 @@ func (h *Host) computeScore(c Computer) {
 			score += h.timeSeries[t].score * decay
 		} else {
 			// XXX no trials recorded, neither promote nor demote the host
-			score += 0.5 * decay
+			score += h.neutral * decay
 		}
 	}
 	if c != nil {
 		score = c.Compute(score) // apply the service score calculator
 	}
 	h.score = score
+	h.scoredAt = time.Now()
 	h.Unlock()
 }
 
+// Invalidate the memoized score, the host is treated as unscored until the next computation.
+func (h *Host) invalidate() {
+	if !h.memoized {
+		return // scores aren't computed (e.g. RoundRobin)
+	}
+	h.Lock()
+	h.score = -1
+	h.scoredAt = time.Now()
+	h.Unlock()
+}
+
+// Seed the score of the host as if it had been learned from the given feedback.
+func (h *Host) seed(score float64) {
+	h.Lock()
+	h.timeSeries[h.timeSlot] = serie{score: score, trials: 1}
+	h.score = score
+	h.scoredAt = time.Now()
+	h.Unlock()
+}
+
+// Reset the score of the host, discarding every feedback recorded so far.
+func (h *Host) reset() {
+	h.Lock()
+	h.timeSeries = make([]serie, 1, seriesNum)
+	h.timeSlot = 0
+	h.score = -1
+	h.scoredAt = time.Now()
+	h.Unlock()
+}
+
+// Address returns the address of the host.
+func (h *Host) Address() string {
+	return h.pool.Address()
+}
+
+// Stats returns a snapshot of the host statistics, the score being reported regardless of the HostScoreFloor.
+func (h *Host) Stats() (s HostStats) {
+	h.RLock()
+	s.Score = -1
+	if h.memoized {
+		s.Score = h.score
+	}
+	if !h.scoredAt.IsZero() {
+		s.ScoreAge = time.Since(h.scoredAt)
+	}
+	s.CheckoutP50 = h.checkouts.percentile(0.5)
+	s.CheckoutP90 = h.checkouts.percentile(0.9)
+	s.CheckoutP99 = h.checkouts.percentile(0.99)
+	h.RUnlock()
+	s.Waiters = h.pool.Waiters()
+	return
+}
+
+// Trials returns the total number of observations recorded across all the time slots.
+func (h *Host) Trials() (n uint64) {
+	h.RLock()
+	for _, s := range h.timeSeries {
+		n += uint64(s.trials)
+	}
+	h.RUnlock()
+	return
+}
+
+// TrialsInSlot returns the number of observations recorded in a given time slot,
+// 0 being the current slot and n being the slot n decays ago.
+// It returns 0 if the slot is out of range.
+func (h *Host) TrialsInSlot(slot int) (n uint32) {
+	h.RLock()
+	if l := len(h.timeSeries); slot >= 0 && slot < l {
+		n = h.timeSeries[(h.timeSlot-slot+l)%l].trials
+	}
+	h.RUnlock()
+	return
+}
+
+// Returns a copy of the host bound to a given pool, scoring included.
+// Feedback from connections still checked out of the original host is forwarded to the copy.
+func (h *Host) clone(p *Pool) *Host {
+	h.Lock()
+	n := &Host{
+		pool:       p,
+		timeSeries: append(make([]serie, 0, seriesNum), h.timeSeries...),
+		selections: atomic.LoadUint64(&h.selections),
+		timeSlot:   h.timeSlot,
+		score:      h.score,
+		scoredAt:   h.scoredAt,
+		decayedAt:  h.decayedAt,
+		memoized:   h.memoized,
+		neutral:    h.neutral,
+		floor:      h.floor,
+		stats:      h.stats,
+		quit:       make(chan struct{}),
+		checkouts:  h.checkouts,
+		inflight:   h.inflight,
+		tags:       h.tags,
+	}
+	h.next = n
+	h.Unlock()
+	return n
+}
+
+// Returns the latest copy of the host (see clone), itself if it was never superseded.
+func (h *Host) latest() *Host {
+	for {
+		h.RLock()
+		n := h.next
+		h.RUnlock()
+		if n == nil {
+			return h
+		}
+		h = n
+	}
+}
+
+// Returns true if the host has been removed from its service.
+func (h *Host) removed() bool {
+	select {
+	case <-h.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 // Score returns the computed score of a given host.
-// It returns -1 if the score hasn't been computed yet (see Service.MemoizeScoreDuration).
+// It returns -1 if the score hasn't been computed yet (see Service.MemoizeScoreDuration),
+// or if it has been invalidated following a fatal connection error.
+// Computed scores below the service HostScoreFloor are raised to the floor, Stats returns the actual score.
 func (h *Host) Score() (score float64) {
 	h.RLock()
 	score = h.score
 	h.RUnlock()
+	if h.memoized && score >= 0 && score < h.floor {
+		return h.floor
+	}
 	return
 }
 
+// Returns the score of the host as reported to users (e.g. DebugInfo, OnSelect), -1 if the service BanditStrategy
+// doesn't compute scores, the score being then used for scheduling (see RoundRobin).
+func (h *Host) reportedScore() float64 {
+	if !h.memoized {
+		return -1
+	}
+	return h.Score()
+}
+
 func (h *Host) decay() {
 	h.Lock()
-	// Shift the current time slot
+	h.shift()
+	h.Unlock()
+}
+
+// Decay the host as many times as decay intervals elapsed since the last decay (at least once).
+// This keeps the time window accurate even if decays are delayed or coalesced.
+func (h *Host) decayAt(now time.Time, interval time.Duration) {
+	n := 1
+
+	h.Lock()
+	if !h.decayedAt.IsZero() && interval > 0 {
+		if i := int((now.Sub(h.decayedAt) + interval/2) / interval); i > n {
+			n = i
+		}
+	}
+	if n > seriesNum {
+		n = seriesNum // the whole time series is outdated
+	}
+	for i := 0; i < n; i++ {
+		h.shift()
+	}
+	h.decayedAt = now
+	h.Unlock()
+}
+
+// Shift the current time slot.
+func (h *Host) shift() {
 	h.timeSlot = (h.timeSlot + 1) % cap(h.timeSeries)
 	if len(h.timeSeries) < cap(h.timeSeries) {
 		h.timeSeries = append(h.timeSeries, serie{})
 	} else {
 		h.timeSeries[h.timeSlot].reset()
 	}
+	h.checkouts.decay()
+}
+
+// Rearrange the time series in chronological order, the current slot being the last.
+// Slots keep their age and thus their weight (see computeScore), neither trials nor scores are affected.
+func (h *Host) defragment() {
+	h.Lock()
+	n := len(h.timeSeries)
+	ts := make([]serie, 0, cap(h.timeSeries))
+	for i := 1; i <= n; i++ {
+		ts = append(ts, h.timeSeries[(h.timeSlot+i)%n])
+	}
+	h.timeSeries = ts
+	h.timeSlot = n - 1
 	h.Unlock()
 }
 
 func (h *Host) rate(score float64) {
+	h.rateN(score, 1)
+}
+
+// Rates the host as if the given score was observed n times.
+func (h *Host) rateN(score float64, n uint32) {
 	h.Lock()
-	h.timeSeries[h.timeSlot].update(score)
+	h.timeSeries[h.timeSlot].update(score, n)
 	h.Unlock()
 }
 
-func (h *Host) releaseConn(c *Conn, e error, score float64) error {
-	dt := int64(c.diffTime().Seconds() * 1000)
+func (h *Host) releaseConn(c *Conn, e error, score float64, weight uint32) error {
+	h.inflight.remove(c)
+	d := c.diffTime()
+
+	dt := int64(d / time.Millisecond)
 	h.stats.Timing("conns.active.period", dt, sampleRate)
 	h.stats.Inc("conns.put.count", 1, sampleRate)
+	if m := c.measured; m != nil {
+		h.stats.Inc("conns.bytes.read", int64(m.BytesRead()), sampleRate)
+		h.stats.Inc("conns.bytes.written", int64(m.BytesWritten()), sampleRate)
+		c.measured = nil
+	}
 
 	down, err := h.pool.Put(c, e)
 	if err != nil {
 		return err
 	}
 	if down {
-		h.rate(HostDown)
-	} else {
-		h.rate(score)
+		score = HostDown
 	}
+	h = h.latest()
+	h.Lock()
+	h.checkouts.add(d)
+	h.timeSeries[h.timeSlot].update(score, weight)
+	if down && h.memoized {
+		h.score = -1 // invalidated
+		h.scoredAt = time.Now()
+	}
+	h.Unlock()
 	return nil
 }
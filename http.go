@@ -1,27 +1,200 @@
 package pooly
 
 import (
+	"bytes"
+	"context"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// NewHTTPTransport returns a transport dialing connections from the given service.
+// Connections are kept alive across requests, they remain checked out from the service until the transport closes
+// them (e.g. once idle for IdleConnTimeout, see http.Transport.CloseIdleConnections). They are then released and the
+// host is scored according to the status code of the last HTTP response received (see HTTPCloseWrapper).
+// Dials fail with ErrNotNetConn if the service driver doesn't create net.Conn connections.
 func NewHTTPTransport(service *Service) *http.Transport {
-	dial := func(network, addr string) (net.Conn, error) {
-		c, err := service.GetConn()
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := service.getConn(ctx, getOptions{}) // the dial timeout doesn't govern the connection I/O
 		if err != nil {
 			return nil, err
 		}
-
-		w := &releaseWrapper{
-			Conn: c.NetConn(),
-			conn: c,
+		if c.NetConn() == nil {
+			c.Release(nil, *service.NeutralScore) // misconfiguration, not the host fault
+			return nil, ErrNotNetConn
 		}
-		return w, nil
+		return newHTTPCloseWrapper(c, *service.HTTPClientErrorScore), nil
 	}
 
 	return &http.Transport{
-		Dial:                dial,
-		DisableKeepAlives:   true,
-		MaxIdleConnsPerHost: 1,
+		DialContext: dial,
+	}
+}
+
+// Returns the score of a host given the status code of an HTTP response: 5xx are scored HostDown,
+// 4xx are scored clientError and everything else is scored HostUp.
+func httpStatusScore(code int, clientError float64) float64 {
+	switch {
+	case code >= 500:
+		return HostDown
+	case code >= 400:
+		return clientError
+	default:
+		return HostUp
+	}
+}
+
+// Records the status code of the last HTTP response read from a connection.
+// Informational responses (1xx) are skipped in favor of the final one.
+// XXX requests aren't pipelined by http.Transport, a response is thus expected once a request is written
+type responseRecorder struct {
+	net.Conn
+
+	sync.Mutex
+	done          bool   // the final status line was read
+	informational bool   // an informational response (1xx) was read, the final status line is still expected
+	line          []byte // status line read so far
+	status        int
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.Lock()
+	r.done, r.informational = false, false // a new response is expected
+	r.line = r.line[:0]
+	r.Unlock()
+	return r.Conn.Write(b)
+}
+
+func (r *responseRecorder) Read(b []byte) (n int, err error) {
+	n, err = r.Conn.Read(b)
+	if n > 0 {
+		r.Lock()
+		r.scan(b[:n])
+		r.Unlock()
+	}
+	return
+}
+
+// Accumulates the status line (e.g. "HTTP/1.1 200 OK") of the response and parses its status code once complete.
+// The header lines of informational responses are skipped until the final status line.
+func (r *responseRecorder) scan(b []byte) {
+	for !r.done {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			r.line = append(r.line, b...)
+			return
+		}
+		r.line = append(r.line, b[:i]...)
+		b = b[i+1:]
+
+		f := bytes.Fields(r.line)
+		r.line = r.line[:0]
+		if len(f) >= 2 && bytes.HasPrefix(f[0], []byte("HTTP/")) {
+			code, err := strconv.Atoi(string(f[1]))
+			if err == nil && code < 200 {
+				r.informational = true
+				continue
+			}
+			if err == nil {
+				r.status = code
+			}
+		} else if r.informational {
+			continue // header of an informational response
+		}
+		r.done = true
+		r.line = nil
+	}
+}
+
+// Returns the status code of the last HTTP response read, 0 if none was.
+func (r *responseRecorder) statusCode() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.status
+}
+
+// HTTPCloseWrapper is the net.Conn dialed by NewHTTPTransport. It records the status code of the last HTTP response
+// read through it and, on Close, releases the underlying connection scoring the host accordingly:
+// 2xx are scored HostUp, 4xx are scored ServiceConfig.HTTPClientErrorScore and 5xx are scored HostDown.
+// I/O errors are reported on release like Service.DialBest does.
+type HTTPCloseWrapper struct {
+	*releaseWrapper
+
+	recorder    *responseRecorder
+	clientError float64
+
+	sync.Mutex
+	closed bool
+	reads  sync.WaitGroup // reads in progress, only added to while not closed
+}
+
+func newHTTPCloseWrapper(c *Conn, clientError float64) *HTTPCloseWrapper {
+	r := &responseRecorder{Conn: c.NetConn()}
+	return &HTTPCloseWrapper{
+		releaseWrapper: &releaseWrapper{Conn: r, conn: c},
+		recorder:       r,
+		clientError:    clientError,
+	}
+}
+
+// StatusCode returns the status code of the last HTTP response read from the connection, 0 if none was.
+func (w *HTTPCloseWrapper) StatusCode() int {
+	return w.recorder.statusCode()
+}
+
+func (w *HTTPCloseWrapper) Read(b []byte) (int, error) {
+	w.Lock()
+	if w.closed {
+		w.Unlock()
+		return 0, net.ErrClosed
+	}
+	w.reads.Add(1)
+	w.Unlock()
+
+	defer w.reads.Done()
+	return w.releaseWrapper.Read(b)
+}
+
+func (w *HTTPCloseWrapper) Write(b []byte) (int, error) {
+	w.Lock()
+	closed := w.closed
+	w.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	return w.releaseWrapper.Write(b)
+}
+
+// Close releases the connection, scoring the host according to the last HTTP status code received.
+// If no response was received, the host is scored like Service.DialBest connections are.
+func (w *HTTPCloseWrapper) Close() error {
+	w.Lock()
+	if w.closed {
+		w.Unlock()
+		return net.ErrClosed
+	}
+	w.closed = true
+	w.Unlock()
+
+	code, err, ioscore := w.StatusCode(), w.lasterr.Load(), w.score()
+
+	// XXX the transport keeps reading idle connections, interrupt it before handing the connection back to the pool
+	nc := w.conn.NetConn()
+	nc.SetReadDeadline(time.Unix(1, 0))
+	w.reads.Wait()
+	nc.SetReadDeadline(time.Time{})
+
+	if code == 0 {
+		if err == nil {
+			return w.conn.Release(nil, HostUp)
+		}
+		return w.conn.Release(err, ioscore)
+	}
+	score := httpStatusScore(code, w.clientError)
+	if err != nil {
+		return w.conn.Release(err, score)
 	}
+	return w.conn.Release(nil, score)
 }
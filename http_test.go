@@ -0,0 +1,182 @@
+package pooly
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPTransportStatusScore(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/notfound":
+			w.WriteHeader(http.StatusNotFound)
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	clientError := 0.3
+	tests := []struct {
+		path        string
+		clientError *float64
+		score       float64
+	}{
+		{"/", nil, HostUp},
+		{"/notfound", nil, DefaultHTTPClientErrorScore},
+		{"/notfound", &clientError, clientError},
+		{"/error", nil, HostDown},
+	}
+	for _, test := range tests {
+		s, err := NewService("http", &ServiceConfig{HTTPClientErrorScore: test.clientError})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.AddSync(addr)
+
+		tr := NewHTTPTransport(s)
+		client := &http.Client{Transport: tr}
+		resp, err := client.Get(srv.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		tr.CloseIdleConnections()
+
+		s.RLock()
+		h := s.hosts[addr]
+		s.RUnlock()
+		waitUntil(t, func() bool { return h.Trials() > 0 }) // wait for the connection to be released
+		h.computeScore(nil)
+		if score := h.Score(); score != test.score {
+			t.Fatal("bad score for", test.path, "expected", test.score, "got", score)
+		}
+		s.Close()
+	}
+
+	invalid := 1.5
+	if _, err := NewService("http", &ServiceConfig{HTTPClientErrorScore: &invalid}); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+}
+
+func TestHTTPTransportKeepAlive(t *testing.T) {
+	var remotes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remotes = append(remotes, r.RemoteAddr)
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	s, err := NewService("http", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(addr)
+	s.RLock()
+	h := s.hosts[addr]
+	s.RUnlock()
+	waitUntil(t, s.AllConnsIdle) // the prespawned connections dialed
+
+	tr := NewHTTPTransport(s)
+	client := &http.Client{Transport: tr}
+	for _, path := range []string{"/error", "/"} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if len(remotes) != 2 || remotes[0] != remotes[1] {
+		t.Fatal("requests over a single connection expected, got", remotes)
+	}
+	if s.AllConnsIdle() || h.Trials() > 0 {
+		t.Fatal("connection checked out expected")
+	}
+
+	tr.CloseIdleConnections()
+	waitUntil(t, func() bool { return h.Trials() > 0 }) // wait for the connection to be released
+	if !s.AllConnsIdle() {
+		t.Fatal("connection released expected")
+	}
+	h.computeScore(nil)
+	if score := h.Score(); score != HostUp {
+		t.Fatal("host scored on the last response expected, got", score)
+	}
+
+	// The connection released is reusable
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc := c.NetConn()
+	io.WriteString(nc, "GET / HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(nc, buf); err != nil || string(buf) != "HTTP/1.1 200" {
+		t.Fatal("reusable connection expected, got", string(buf), err)
+	}
+	c.Release(nil, HostUp)
+}
+
+func TestHTTPTransportNotNetConn(t *testing.T) {
+	s, err := NewService("nop", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+
+	client := &http.Client{Transport: NewHTTPTransport(s)}
+	if _, err := client.Get("http://" + echo1); !errors.Is(err, ErrNotNetConn) {
+		t.Fatal("not a net.Conn error expected, got", err)
+	}
+	waitUntil(t, s.AllConnsIdle) // the connection released and the prespawned ones dialed
+}
+
+func TestResponseRecorder(t *testing.T) {
+	r := &responseRecorder{}
+	if r.statusCode() != 0 {
+		t.Fatal("no status code expected")
+	}
+
+	// Status line split across reads
+	r.scan([]byte("HTTP/1.1 50"))
+	r.scan([]byte("3 Service Unavailable\r\nContent-Length: 0\r\n\r\n"))
+	if r.statusCode() != 503 {
+		t.Fatal("503 status code expected, got", r.statusCode())
+	}
+
+	// The body doesn't count
+	r.scan([]byte("HTTP/1.1 200 OK\r\n"))
+	if r.statusCode() != 503 {
+		t.Fatal("503 status code expected, got", r.statusCode())
+	}
+
+	// Informational responses precede the final one
+	r = &responseRecorder{}
+	r.scan([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	r.scan([]byte("HTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\nHTTP/1.1 404 Not Found\r\n"))
+	if r.statusCode() != 404 {
+		t.Fatal("404 status code expected, got", r.statusCode())
+	}
+	r.scan([]byte("HTTP/1.1 200 OK\r\n"))
+	if r.statusCode() != 404 {
+		t.Fatal("404 status code expected, got", r.statusCode())
+	}
+}
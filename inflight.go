@@ -0,0 +1,76 @@
+package pooly
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// InFlightInfo describes a connection currently checked out from a service (see Service.InFlight).
+type InFlightInfo struct {
+	// Connection identifier (see Conn.ID).
+	ID uint64
+
+	// Address of the host the connection belongs to.
+	Address string
+
+	// Time elapsed since the connection was checked out.
+	Age time.Duration
+
+	// Stack trace of the goroutine which checked out the connection.
+	Stack string
+}
+
+// Tracks the connections checked out, a nil tracker tracks nothing.
+type inFlightTracker struct {
+	sync.Mutex
+	conns map[*Conn]string
+}
+
+func newInFlightTracker() *inFlightTracker {
+	return &inFlightTracker{conns: make(map[*Conn]string)}
+}
+
+func (t *inFlightTracker) add(c *Conn) {
+	if t == nil {
+		return
+	}
+	buf := make([]byte, 4096)
+	buf = buf[:runtime.Stack(buf, false)]
+
+	t.Lock()
+	t.conns[c] = string(buf)
+	t.Unlock()
+}
+
+func (t *inFlightTracker) remove(c *Conn) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	delete(t.conns, c)
+	t.Unlock()
+}
+
+func (t *inFlightTracker) list() []InFlightInfo {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+
+	t.Lock()
+	l := make([]InFlightInfo, 0, len(t.conns))
+	for c, stack := range t.conns {
+		i := InFlightInfo{
+			ID:    c.id,
+			Age:   now.Sub(c.gottenAt),
+			Stack: stack,
+		}
+		if c.pool != nil {
+			i.Address = c.pool.Address()
+		}
+		l = append(l, i)
+	}
+	t.Unlock()
+	return l
+}
@@ -0,0 +1,37 @@
+package pooly
+
+import "sync"
+
+// MultiConn is a set of connections to distinct hosts (see Service.GetConnAll).
+type MultiConn []*Conn
+
+// WriteAll writes the same data to all the connections concurrently (see Conn.Write).
+// It returns the least number of bytes written to a connection, along with the first error encountered if any.
+// Connections whose underlying user object is not a net.Conn fail with ErrNotNetConn.
+func (m MultiConn) WriteAll(p []byte) (int, error) {
+	var w sync.WaitGroup
+
+	ns := make([]int, len(m))
+	errs := make([]error, len(m))
+	w.Add(len(m))
+	for i, c := range m {
+		go func(i int, c *Conn) {
+			ns[i], errs[i] = c.Write(p)
+			w.Done()
+		}(i, c)
+	}
+	w.Wait()
+
+	n := len(p)
+	for i := range m {
+		if ns[i] < n {
+			n = ns[i]
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -76,3 +76,19 @@ func (n *NetDriver) Temporary(err error) bool {
 	}
 	return false
 }
+
+// UnixDriver is a predefined driver for handling Unix domain socket connections.
+// On Linux, addresses starting with '@' or a null byte refer to the abstract socket namespace.
+type UnixDriver struct {
+	*NetDriver
+}
+
+// NewUnixDriver instantiates a new UnixDriver, ready to be used in a PoolConfig.
+func NewUnixDriver() *UnixDriver {
+	return &UnixDriver{NewNetDriver("unix")}
+}
+
+// Dial is analogous to net.Dial.
+func (u *UnixDriver) Dial(address string) (*Conn, error) {
+	return u.NetDriver.Dial(unixAddress(address))
+}
@@ -1,7 +1,18 @@
 package pooly
 
 import (
+	"context"
+	"fmt"
 	"github.com/cactus/go-statsd-client/statsd"
+	"golang.org/x/time/rate"
+	"net"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
 	"time"
 )
 
@@ -29,8 +40,13 @@ type PoolConfig struct {
 
 	// Close connections after remaining idle for this duration.
 	// If the value is zero (default), then idle connections are not closed.
+	// The idle countdown restarts every time a connection is returned to the pool (see FixedIdle).
 	ConnIdleTimeout time.Duration
 
+	// Count ConnIdleTimeout from the connection creation rather than from its last use (false by default).
+	// Idle connections are then closed once they are older than ConnIdleTimeout.
+	FixedIdle bool
+
 	// Defines the duration during which Get operations will try to return a connection from the pool.
 	// If the value is zero (default), then Get should wait forever.
 	WaitTimeout time.Duration
@@ -43,8 +59,74 @@ type PoolConfig struct {
 
 	// Time interval between connection retry (DefaultRetryDelay by default).
 	RetryDelay time.Duration
+
+	// Maximum number of dials per second, shared across all the connections being spawned (unlimited by default).
+	DialRateLimit rate.Limit
+
+	// Maximum number of dials allowed at once when DialRateLimit is set (1 by default).
+	DialBurst int
+
+	// Order in which idle connections are handed out by Get (FIFOEviction by default).
+	EvictionPolicy EvictionPolicy
+
+	// Skip TestOnBorrow for connections returned to the pool within this duration, assuming they are still healthy.
+	// If the value is zero (default), then connections are tested on every Get.
+	ValidationGracePeriod time.Duration
+
+	// Behavior of Get when MaxConns is reached and no connection is idle (WaitOnExhaustion by default).
+	OnExhausted ExhaustionPolicy
+
+	// Hard cap on the number of connections when growing past MaxConns with GrowOnExhaustion (twice MaxConns by default).
+	HardMaxConns int32
+
+	// Optional hook called each time Get returns a connection, once tested (none by default).
+	// fresh tells whether the connection was just dialed, as opposed to being reused.
+	OnGet func(c *Conn, fresh bool)
+
+	// Interval at which idle connections in excess of ShrinkTarget are closed (see Pool.ShrinkIdle).
+	// If the value is zero (default), then the pool is never shrunk periodically.
+	ShrinkInterval time.Duration
+
+	// Number of idle connections to keep when shrinking the pool periodically (none by default).
+	ShrinkTarget int32
+
+	// Tag the goroutines spawned by the pool with pprof labels (pool address and role).
+	// Labels are only applied when this is true in order to avoid the overhead in production (false by default).
+	EnablePprofLabels bool
 }
 
+// EvictionPolicy defines the order in which idle connections are handed out by the pool.
+type EvictionPolicy int
+
+// Eviction policies.
+const (
+	// Connections are handed out in the order they were returned to the pool.
+	FIFOEviction EvictionPolicy = iota
+
+	// The most recently returned connections are handed out first, leaving the others to time out.
+	LRUEviction
+
+	// Connections are handed out in turn, cycling through them in ID order regardless of the order they were returned.
+	// This exercises every connection evenly (e.g. to surface a single bad connection among many).
+	RoundRobinEviction
+)
+
+// ExhaustionPolicy defines the behavior of the pool when MaxConns is reached and no connection is idle.
+type ExhaustionPolicy int
+
+// Exhaustion policies.
+const (
+	// Get waits for a connection to be put back, up to WaitTimeout.
+	WaitOnExhaustion ExhaustionPolicy = iota
+
+	// Get fails right away with ErrPoolExhausted.
+	FailOnExhaustion
+
+	// Get dials a temporary connection, up to HardMaxConns. Temporary connections are closed once put back.
+	// Get waits as with WaitOnExhaustion when HardMaxConns is reached.
+	GrowOnExhaustion
+)
+
 // Pool maintains a pool of connections. The application calls the Get method to get a connection
 // from the pool and the Put method to return the connection to the pool.
 // New can be called to allocate more connections in the background.
@@ -52,18 +134,204 @@ type PoolConfig struct {
 // The pool itself will adapt to the demand by spawning and destroying connections as needed.
 // In order to tweak its behavior, settings like ConnIdleTimeout and MaxConns may be used.
 type Pool struct {
+	// XXX must be 64-bit aligned for atomic operations, keep it first
+	lastID uint64
+
 	*PoolConfig
 
-	address    string
+	ids        *uint64 // source of connection IDs, lastID unless shared with other pools (see setIDs)
+	address    atomic.Value
+	wait       atomic.Value
 	status     state
 	inbound    channel
 	connsCount counter
+	connsUp    int32
+	waiters    int32
+	badBorrows uint32
+	bursts     int32
+	observing  sync.RWMutex // held exclusively while idle connections are observed
 	conns      chan *Conn
 	gc         chan *Conn
 	gcCtl      chan int
+	quit       chan struct{} // closed on teardown (see stop)
+	quitOnce   sync.Once
+	drv        atomic.Value
+	limiter    *rate.Limiter
+	events     eventStream
+	idle       idleSet
+	order      *idleList
 	stats      statsd.Statter
 }
 
+// List of the idle connections, in the order they are handed out (see EvictionPolicy).
+// The conns queue only serves as a counting semaphore, the connections being handed out from the list.
+// XXX the list is intrusive (see Conn.prev and Conn.next) in order to spare an allocation per Put
+type idleList struct {
+	sync.Mutex
+	head *Conn
+	tail *Conn
+	last uint64 // ID of the last connection popped in turn
+}
+
+func newIdleList() *idleList {
+	return new(idleList)
+}
+
+func (l *idleList) pushFront(c *Conn) {
+	l.Lock()
+	c.prev, c.next, c.listed = nil, l.head, true
+	if l.head != nil {
+		l.head.prev = c
+	} else {
+		l.tail = c
+	}
+	l.head = c
+	l.Unlock()
+}
+
+func (l *idleList) pushBack(c *Conn) {
+	l.Lock()
+	c.prev, c.next, c.listed = l.tail, nil, true
+	if l.tail != nil {
+		l.tail.next = c
+	} else {
+		l.head = c
+	}
+	l.tail = c
+	l.Unlock()
+}
+
+// Unlinks a given connection, the lock must be held.
+func (l *idleList) unlink(c *Conn) {
+	if c.prev != nil {
+		c.prev.next = c.next
+	} else {
+		l.head = c.next
+	}
+	if c.next != nil {
+		c.next.prev = c.prev
+	} else {
+		l.tail = c.prev
+	}
+	c.prev, c.next, c.listed = nil, nil, false
+}
+
+func (l *idleList) popFront() (c *Conn) {
+	l.Lock()
+	if c = l.head; c != nil {
+		l.unlink(c)
+	}
+	l.Unlock()
+	return
+}
+
+// Pops the connection following the last one popped in ID order, wrapping around to the lowest ID.
+func (l *idleList) popNext() (c *Conn) {
+	var first, next *Conn
+
+	l.Lock()
+	for v := l.head; v != nil; v = v.next {
+		if first == nil || v.id < first.id {
+			first = v
+		}
+		if v.id > l.last && (next == nil || v.id < next.id) {
+			next = v
+		}
+	}
+	if next == nil {
+		next = first
+	}
+	if next != nil {
+		l.unlink(next)
+		l.last = next.id
+	}
+	l.Unlock()
+	return next
+}
+
+// Returns the first connection satisfying a given predicate, if any.
+func (l *idleList) first(pred func(*Conn) bool) *Conn {
+	l.Lock()
+	defer l.Unlock()
+	for c := l.head; c != nil; c = c.next {
+		if pred(c) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Removes a given connection, it returns false if it is not in the list.
+func (l *idleList) remove(c *Conn) (ok bool) {
+	l.Lock()
+	if ok = c.listed; ok {
+		l.unlink(c)
+	}
+	l.Unlock()
+	return
+}
+
+// Set of the idle connections IDs, along with their state when they were queued.
+type idleSet struct {
+	sync.Mutex
+	ids map[uint64]idleState
+}
+
+type idleState struct {
+	conn      *Conn
+	createdAt time.Time
+	idleSince time.Time
+	tested    bool
+	testErr   error
+}
+
+func (s *idleSet) add(c *Conn) {
+	s.Lock()
+	if s.ids == nil {
+		s.ids = make(map[uint64]idleState)
+	}
+	s.ids[c.id] = idleState{c, c.createdAt, c.idleSince, c.tested, c.testErr}
+	s.Unlock()
+}
+
+func (s *idleSet) has(id uint64) (ok bool) {
+	s.Lock()
+	_, ok = s.ids[id]
+	s.Unlock()
+	return
+}
+
+func (s *idleSet) remove(id uint64) {
+	s.Lock()
+	delete(s.ids, id)
+	s.Unlock()
+}
+
+func (s *idleSet) len() (n int) {
+	s.Lock()
+	n = len(s.ids)
+	s.Unlock()
+	return
+}
+
+func (s *idleSet) list() []uint64 {
+	s.Lock()
+	ids := make([]uint64, 0, len(s.ids))
+	for id := range s.ids {
+		ids = append(ids, id)
+	}
+	s.Unlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (s *idleSet) state(id uint64) (st idleState, ok bool) {
+	s.Lock()
+	st, ok = s.ids[id]
+	s.Unlock()
+	return
+}
+
 // Pool status.
 const (
 	active int32 = iota
@@ -95,27 +363,202 @@ func NewPool(address string, c *PoolConfig) *Pool {
 	if c.RetryDelay == 0 {
 		c.RetryDelay = DefaultRetryDelay
 	}
+	if c.DialBurst <= 0 {
+		c.DialBurst = 1
+	}
+	if c.HardMaxConns < c.MaxConns {
+		c.HardMaxConns = 2 * c.MaxConns
+	}
 
 	p := &Pool{
 		PoolConfig: c,
-		address:    address,
 		status:     newState(active),
 		connsCount: newCounter(c.MaxConns),
 		conns:      make(chan *Conn, c.MaxConns),
 		gc:         make(chan *Conn, c.MaxConns),
 		gcCtl:      make(chan int, 1),
+		quit:       make(chan struct{}),
+		events:     newEventStream(),
 	}
+	p.ids = &p.lastID
+	p.address.Store(address)
+	p.wait.Store(c.WaitTimeout)
 	p.inbound = newChannel(&p.conns)
+	p.order = newIdleList()
+	p.drv.Store(driverBox{c.Driver})
 	p.stats, _ = statsd.NewNoopClient()
+	if c.DialRateLimit > 0 {
+		p.limiter = rate.NewLimiter(c.DialRateLimit, c.DialBurst)
+	}
 
-	go p.collect()
+	go p.do("gc", p.collect)
+	if c.ShrinkInterval > 0 {
+		go p.do("shrink", p.shrink)
+	}
 	return p
 }
 
+// Shares a source of connection IDs with other pools, making IDs unique across them.
+// It must be called before any connection is spawned.
+func (p *Pool) setIDs(ids *uint64) {
+	p.ids = ids
+}
+
+// Returns a new connection ID.
+func (p *Pool) nextID() uint64 {
+	return atomic.AddUint64(p.ids, 1)
+}
+
+// Run a pool routine, labeled with its role if profiling labels are enabled.
+func (p *Pool) do(role string, f func()) {
+	if !p.EnablePprofLabels {
+		f()
+		return
+	}
+	labels := pprof.Labels("pool", p.Address(), "role", role)
+	pprof.Do(context.Background(), labels, func(context.Context) { f() })
+}
+
+// Boxing allows drivers of different types to be swapped atomically.
+type driverBox struct{ Driver }
+
+func (p *Pool) driver() Driver {
+	return p.drv.Load().(driverBox).Driver
+}
+
+// Returns the driver the given connection was created with.
+func (p *Pool) driverOf(c *Conn) Driver {
+	if c.driver != nil {
+		return c.driver
+	}
+	return p.driver()
+}
+
+// Returns the address a given connection was dialed with, connections spawned outside the pool default to its address.
+func (p *Pool) addressOf(c *Conn) string {
+	if c.address != "" {
+		return c.address
+	}
+	return p.Address()
+}
+
+// SetDriver replaces the driver of the pool.
+// Connections created afterwards use the new driver, while existing ones are closed with the old driver
+// and replaced as soon as they are returned to the pool.
+// Note that the driver of the pool configuration remains unchanged.
+func (p *Pool) SetDriver(d Driver) error {
+	if d == nil {
+		return ErrInvalidArg
+	}
+	if p.status.is(closing) {
+		return ErrPoolClosed
+	}
+	p.drv.Store(driverBox{d})
+	return nil
+}
+
 func (p *Pool) setStats(s statsd.Statter) {
 	p.stats = s
 }
 
+// Hands out a given connection once tested.
+func (p *Pool) checkout(c *Conn) {
+	fresh := !c.reused
+	c.borrowed, c.reused = true, true
+	p.events.emit(ConnCheckedOut, c, 0)
+	if p.OnGet != nil {
+		p.OnGet(c, fresh)
+	}
+}
+
+// Tests a given connection (see Driver.TestOnBorrow), the outcome is recorded for Introspect.
+func (p *Pool) test(c *Conn) error {
+	err := p.driverOf(c).TestOnBorrow(c)
+	c.tested, c.testErr = true, err
+	return err
+}
+
+// Tests a given connection on borrow, unless it was queued within the ValidationGracePeriod.
+func (p *Pool) validate(c *Conn) error {
+	if p.ValidationGracePeriod > 0 && time.Since(c.idleSince) < p.ValidationGracePeriod {
+		return nil
+	}
+	return p.test(c)
+}
+
+// Queues a connection to the pool, it becomes available to Get and its idle timer starts.
+func (p *Pool) enqueue(c *Conn) {
+	c.idleSince = time.Now()
+	armed := c.setIdle(p)
+	p.queue(c)
+	if armed {
+		// XXX watch the timer once queued only, the connection can't be garbage collected beforehand
+		c.watchIdle(p)
+	}
+}
+
+func (p *Pool) queue(c *Conn) {
+	p.idle.add(c)
+	if p.EvictionPolicy == LRUEviction {
+		p.order.pushFront(c)
+	} else {
+		p.order.pushBack(c)
+	}
+	p.inbound.channel() <- c
+}
+
+// Puts back idle connections taken out of the pool, preserving their order and idle time.
+func (p *Pool) requeue(conns []*Conn) {
+	if p.EvictionPolicy != LRUEviction {
+		for _, c := range conns {
+			p.queue(c)
+		}
+		return
+	}
+	for i := len(conns) - 1; i >= 0; i-- {
+		p.queue(conns[i])
+	}
+}
+
+// Returns the idle connection to hand out once a slot has been received from the conns queue.
+// It returns nil if there is none left (i.e. it timed out and has been garbage collected).
+func (p *Pool) dequeue(*Conn) (c *Conn) {
+	if p.EvictionPolicy == RoundRobinEviction {
+		c = p.order.popNext()
+	} else {
+		c = p.order.popFront()
+	}
+	if c != nil {
+		p.idle.remove(c.id)
+	}
+	return
+}
+
+// Removes a given connection from the idle ones along with its slot in the conns queue, as dequeue would.
+// It returns false if the connection is not idle.
+func (p *Pool) unqueue(c *Conn) bool {
+	if !p.order.remove(c) {
+		return false
+	}
+	p.idle.remove(c.id)
+	select {
+	case <-p.conns:
+	default:
+		// XXX the slot is being received concurrently, the receiver finds one connection short and starts over
+	}
+	return true
+}
+
+// Closes a given connection, its slot in the connections counter is left to the caller.
+func (p *Pool) destroy(c *Conn) {
+	c.setClosed()
+	p.idle.remove(c.id)
+	p.order.remove(c)
+	p.driverOf(c).Close(c)
+	atomic.AddInt32(&p.connsUp, -1)
+	p.events.emit(ConnClosed, c, 0)
+}
+
 // Garbage collects connections.
 func (p *Pool) collect() {
 	var c *Conn
@@ -143,8 +586,7 @@ func (p *Pool) collect() {
 		if c != nil && !c.isClosed() {
 			// XXX workaround to avoid closing twice a connection
 			// Since idle timeouts can occur at any time, we may have duplicates in the queue
-			c.setClosed()
-			p.Driver.Close(c)
+			p.destroy(c)
 			p.connsCount.decrement()
 		} else if c == nil {
 			p.connsCount.decrement()
@@ -152,36 +594,190 @@ func (p *Pool) collect() {
 	}
 }
 
-func (p *Pool) newConn() {
+// Shrinks the pool down to ShrinkTarget idle connections periodically.
+func (p *Pool) shrink() {
+	t := time.NewTicker(p.ShrinkInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if n := p.IdleConns() - p.ShrinkTarget; n > 0 {
+				p.ShrinkIdle(int(n))
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// Spawns a new connection, it returns false if MaxConns is reached.
+// On failure, the last dialing error is returned (or the context error if it is done).
+func (p *Pool) spawn(ctx context.Context) (ok bool, err error) {
 	if !p.connsCount.increment() {
 		return
 	}
+	return p.dial(ctx)
+}
+
+// Dials a new connection, its slot must have been reserved in the connections counter beforehand.
+func (p *Pool) dial(ctx context.Context) (ok bool, err error) {
+	c, err := p.connect(ctx)
+	if c == nil {
+		p.gc <- nil // connection failed
+		return false, err
+	}
+	if p.addressOf(c) != p.Address() {
+		// The address has been replaced while dialing (see SetAddress), renew the connection in its slot
+		p.destroy(c)
+		return p.dial(ctx)
+	}
+	p.enqueue(c)
+	return true, nil
+}
+
+// Establishes a new connection, leaving it to the caller.
+// On failure, the last dialing error is returned (or the context error if it is done).
+func (p *Pool) connect(ctx context.Context) (c *Conn, err error) {
 	for i := 0; i < p.ConnRetries; i++ {
-		c, err := p.Driver.Dial(p.address)
-		if c != nil && (err == nil || p.Driver.Temporary(err)) {
-			c.setIdle(p)
-			p.inbound.channel() <- c
-			return
+		if p.limiter != nil {
+			if err = p.limiter.Wait(ctx); err != nil {
+				break
+			}
+		}
+		d := p.driver()
+		a := p.Address()
+		c, err = d.Dial(a)
+		if c != nil && (err == nil || d.Temporary(err)) {
+			c.driver = d
+			c.address = a
+			c.id = p.nextID()
+			c.setPool(p)
+			atomic.AddInt32(&p.connsUp, 1)
+			p.events.emit(ConnDialed, c, 0)
+			return c, nil
 		}
 		p.stats.Inc("conns.fails", 1, sampleRate)
-		time.Sleep(p.RetryDelay)
+
+		t := time.NewTimer(p.RetryDelay)
+		select {
+		case <-t.C:
+			continue
+		case <-ctx.Done():
+			t.Stop()
+			err = ctx.Err()
+		}
+		break
 	}
-	p.gc <- nil // connection failed
+	return nil, err
 }
 
 // New attempts to create n new connections in background.
+// It returns the number of connections actually being spawned, which is less than n when MaxConns is reached.
+func (p *Pool) New(n uint) (spawned uint, err error) {
+	return p.NewWithContext(context.Background(), n)
+}
+
+// NewWithContext is like New but the pending connections are given up once the given context is done.
+func (p *Pool) NewWithContext(ctx context.Context, n uint) (spawned uint, err error) {
+	if p.status.is(closing) {
+		return 0, ErrPoolClosed
+	}
+
+	for ; spawned < n; spawned++ {
+		if !p.connsCount.increment() {
+			break // MaxConns reached
+		}
+		go p.do("new-conn", func() { p.dial(ctx) })
+	}
+	return
+}
+
+// BulkNew attempts to create n new connections and waits for them to be established.
+// Connections are dialed concurrently by at most GOMAXPROCS routines in order to avoid thundering herds.
+// It returns the number of connections successfully spawned along with the first error encountered.
 // Note that it does nothing when MaxConns is reached.
-func (p *Pool) New(n uint) error {
-	var i uint
+func (p *Pool) BulkNew(n uint) (spawned uint, err error) {
+	if p.status.is(closing) {
+		return 0, ErrPoolClosed
+	}
+	return p.spawnN(n, func() (bool, error) {
+		return p.spawn(context.Background())
+	})
+}
+
+// WarmAndTest is like BulkNew but also tests the new connections (see Driver.TestOnBorrow) before making them
+// available, garbage collecting the ones failing with a fatal error. This allows to detect misconfigured hosts before
+// serving traffic.
+// It returns the number of connections spawned and tested successfully, the number of connections which failed
+// their test, along with the first error encountered.
+func (p *Pool) WarmAndTest(ctx context.Context, n uint) (ok, failed uint, err error) {
+	var nfailed uint32
 
 	if p.status.is(closing) {
-		return ErrPoolClosed
+		return 0, 0, ErrPoolClosed
 	}
+	ok, err = p.spawnN(n, func() (bool, error) {
+		if !p.connsCount.increment() {
+			return false, nil // MaxConns reached
+		}
+		c, err := p.connect(ctx)
+		if c == nil {
+			p.gc <- nil // connection failed
+			return false, err
+		}
+		if err = p.test(c); err != nil && !p.driverOf(c).Temporary(err) {
+			p.stats.Inc("conns.fails", 1, sampleRate)
+			atomic.AddUint32(&nfailed, 1)
+			p.gc <- c
+			return false, err
+		}
+		p.enqueue(c)
+		return true, nil
+	})
+	return ok, uint(atomic.LoadUint32(&nfailed)), err
+}
+
+// Runs the given spawning function n times, concurrently by at most GOMAXPROCS routines.
+// It returns the number of connections successfully spawned along with the first error encountered.
+func (p *Pool) spawnN(n uint, spawn func() (bool, error)) (spawned uint, err error) {
+	var w sync.WaitGroup
+	var m sync.Mutex
+	var i uint
+
+	workers := uint(runtime.GOMAXPROCS(0))
+	if n < workers {
+		workers = n
+	}
+	sem := make(chan struct{}, workers)
 
 	for i = 0; i < n; i++ {
-		go p.newConn()
+		sem <- struct{}{}
+		w.Add(1)
+		go p.do("new-conn", func() {
+			ok, e := spawn()
+			m.Lock()
+			if ok {
+				spawned++
+			}
+			if e != nil && err == nil {
+				err = e
+			}
+			m.Unlock()
+			<-sem
+			w.Done()
+		})
 	}
-	return nil
+	w.Wait()
+	return
+}
+
+// Events returns a stream of the events occurring in the pool, connections lifecycle transitions included,
+// meant to be consumed by a single reader.
+// Events are only emitted once Events has been called and are dropped if the reader falls behind,
+// so that a slow reader never stalls the pool.
+func (p *Pool) Events() <-chan PoolEvent {
+	return p.events.subscribe()
 }
 
 // ActiveConns returns the number of connections handled by the pool thus far.
@@ -189,10 +785,267 @@ func (p *Pool) ActiveConns() int32 {
 	return p.connsCount.fetch()
 }
 
+// Len returns the number of connections spawned by the pool (see ActiveConns).
+func (p *Pool) Len() int {
+	return int(p.ActiveConns())
+}
+
+// Returns true if MaxConns is reached and every connection is checked out.
+func (p *Pool) saturated() bool {
+	return p.ActiveConns() >= p.MaxConns && p.IdleConns() == 0
+}
+
+// CapacityUsedPercent returns the percentage of MaxConns currently in use by the pool (see ActiveConns).
+func (p *Pool) CapacityUsedPercent() float32 {
+	return (float32(p.ActiveConns()) / float32(p.MaxConns)) * 100
+}
+
+// Returns the number of fatal TestOnBorrow failures since the last call.
+func (p *Pool) takeBorrowFails() uint32 {
+	return atomic.SwapUint32(&p.badBorrows, 0)
+}
+
+// Returns the number of connections established (i.e. not being dialed).
+func (p *Pool) establishedConns() int32 {
+	return atomic.LoadInt32(&p.connsUp)
+}
+
+// Waiters returns the number of goroutines currently blocked in Get, waiting for a connection.
+func (p *Pool) Waiters() int {
+	return int(atomic.LoadInt32(&p.waiters))
+}
+
+// IdleConns returns the number of connections currently idle in the pool.
+func (p *Pool) IdleConns() int32 {
+	return int32(len(p.conns))
+}
+
+// Returns true if no connection is checked out from the pool.
+// XXX IdleConns counts connections timed out but still queued, rely on the idle set instead
+func (p *Pool) empty() bool {
+	return int32(p.idle.len()) >= p.ActiveConns()
+}
+
+// Takes a given idle connection out of the pool, as Get would.
+// It returns nil if the connection is not idle in the pool or fails to be tested.
+func (p *Pool) getByID(id uint64) *Conn {
+	if p.status.is(closing) {
+		return nil
+	}
+	st, ok := p.idle.state(id)
+	if !ok {
+		return nil
+	}
+	p.observing.RLock()
+	ok = p.unqueue(st.conn)
+	p.observing.RUnlock()
+	if !ok {
+		return nil // taken simultaneously
+	}
+	return p.borrow(st.conn)
+}
+
+// Takes the first idle connection satisfying a given predicate out of the pool, as Get would.
+// It returns nil if there is none or if it fails to be tested.
+func (p *Pool) take(pred func(*Conn) bool) *Conn {
+	p.observing.RLock()
+	c := p.order.first(pred)
+	if c == nil || !p.unqueue(c) {
+		p.observing.RUnlock()
+		return nil
+	}
+	p.observing.RUnlock()
+	return p.borrow(c)
+}
+
+// Checks out a connection taken out of the pool once tested.
+// It returns nil if the connection timed out or failed to be tested.
+func (p *Pool) borrow(c *Conn) *Conn {
+	if !c.setActive() {
+		return nil // connection timed out, it is already being garbage collected
+	}
+	if err := p.validate(c); err != nil && !p.driverOf(c).Temporary(err) {
+		p.stats.Inc("conns.fails", 1, sampleRate)
+		atomic.AddUint32(&p.badBorrows, 1)
+		p.gc <- c
+		return nil
+	}
+	p.checkout(c)
+	return c
+}
+
+// GetWith is like Get but only returns a connection satisfying a given predicate (e.g. tagged by the driver, see Conn.SetTags).
+// Idle connections failing the predicate are skipped and new ones are dialed, up to ConnRetries times.
+// If MaxConns is reached, an idle connection failing the predicate is closed to make room for the new one.
+// It returns ErrNoMatchingConn if no connection satisfying the predicate could be obtained.
+func (p *Pool) GetWith(pred func(*Conn) bool) (*Conn, error) {
+	for i := 0; ; i++ {
+		if p.status.is(closing) {
+			return nil, ErrPoolClosed
+		}
+		if c := p.take(pred); c != nil {
+			return c, nil
+		}
+		if i >= p.ConnRetries {
+			return nil, ErrNoMatchingConn
+		}
+
+		var err error
+		if p.connsCount.fetch() >= p.MaxConns {
+			_, err = p.evict()
+		} else {
+			_, err = p.spawn(context.Background())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Replaces an idle connection with a new one, it returns false if there is no idle connection.
+func (p *Pool) evict() (bool, error) {
+	var c *Conn
+
+	p.observing.RLock()
+	select {
+	case c = <-p.conns:
+	default:
+	}
+	p.observing.RUnlock()
+	if c == nil {
+		return false, nil // no idle connection (or pool closed simultaneously)
+	}
+	if c = p.dequeue(c); c == nil || !c.setActive() {
+		return false, nil // connection timed out, it is already being garbage collected
+	}
+	p.destroy(c)
+	return p.dial(context.Background()) // reuse its slot
+}
+
+// ShrinkIdle garbage collects up to n idle connections without waiting, it returns the number of connections closed.
+// This allows to release server resources once a traffic spike is over (see PoolConfig.ShrinkInterval).
+func (p *Pool) ShrinkIdle(n int) int {
+	var closed int
+
+	p.observing.RLock()
+	defer p.observing.RUnlock()
+	for closed < n {
+		var c *Conn
+
+		select {
+		case c = <-p.conns:
+		default:
+		}
+		if c == nil {
+			break // no idle connection left (or pool closed simultaneously)
+		}
+		if c = p.dequeue(c); c == nil || !c.setActive() {
+			continue // connection timed out, it is already being garbage collected
+		}
+		p.gc <- c
+		closed++
+	}
+	return closed
+}
+
+// ObserveConns calls fn with the connections currently idle in the pool (e.g. to inspect them in bulk).
+// Idle connections are taken out of the pool meanwhile and put back as is afterwards, Get operations
+// wait for fn to return instead of spawning new connections, as do the ones taking idle connections out (e.g. ShrinkIdle).
+// fn must not retain, check out nor close the connections.
+func (p *Pool) ObserveConns(fn func(idle []*Conn)) {
+	var conns []*Conn
+
+	p.observing.Lock()
+	defer p.observing.Unlock()
+	for n := len(p.conns); n > 0; n-- {
+		select {
+		case c := <-p.conns:
+			if c == nil {
+				n = 0 // pool closed simultaneously
+			} else if c = p.dequeue(c); c != nil {
+				conns = append(conns, c)
+			}
+		default:
+			n = 0
+		}
+	}
+	fn(conns)
+	p.requeue(conns)
+}
+
+// ConnectionIDs returns the IDs of the connections currently idle in the pool, in ascending order.
+func (p *Pool) ConnectionIDs() []uint64 {
+	return p.idle.list()
+}
+
+// Introspect returns a human-readable table of the idle connections of the pool, for debugging purposes.
+// Each row gives the ID of a connection, its state, its age, how long it has been idle and the outcome of its last test
+// (see Driver.TestOnBorrow). Checked out connections are summed up on a last line.
+func (p *Pool) Introspect() string {
+	var b strings.Builder
+
+	now := time.Now()
+	ids := p.idle.list()
+	w := tabwriter.NewWriter(&b, 0, 0, 1, ' ', tabwriter.Debug)
+	fmt.Fprintln(w, "ID\tState\tAge\tIdleSince\tTestStatus")
+	for _, id := range ids {
+		st, ok := p.idle.state(id)
+		if !ok {
+			continue // checked out meanwhile
+		}
+		status := "untested"
+		if st.testErr != nil {
+			status = st.testErr.Error()
+		} else if st.tested {
+			status = "ok"
+		}
+		fmt.Fprintf(w, "%d\tidle\t%v\t%v\t%s\n", id,
+			now.Sub(st.createdAt).Round(time.Millisecond), now.Sub(st.idleSince).Round(time.Millisecond), status)
+	}
+	w.Flush()
+
+	if n := int(p.establishedConns()) - len(ids); n > 0 {
+		fmt.Fprintf(&b, "[checked out #%d]\n", n)
+	}
+	return b.String()
+}
+
+// WaitEmpty waits until no connection is checked out from the pool (i.e. every active connection is idle).
+// It returns the context error if the given context is done beforehand.
+func (p *Pool) WaitEmpty(ctx context.Context) error {
+	d := 1 * time.Millisecond
+	for !p.empty() {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		if d *= 2; d > 10*time.Millisecond {
+			d = 10 * time.Millisecond
+		}
+	}
+	return nil
+}
+
 // Get gets a fully tested connection from the pool.
 func (p *Pool) Get() (*Conn, error) {
-	var t <-chan time.Time
+	return p.GetContext(context.Background())
+}
+
+// GetContext is like Get but gives up waiting for a connection when the given context is done.
+// In such case, it returns the context error.
+func (p *Pool) GetContext(ctx context.Context) (*Conn, error) {
+	return p.getContext(ctx, 0)
+}
+
+// Gets a connection, giving up with ErrOpTimeout if the connection dialed on demand takes longer than the given
+// budget (unlimited if zero). Waiting for a connection to be released once MaxConns is reached isn't budgeted.
+func (p *Pool) getContext(ctx context.Context, budget time.Duration) (*Conn, error) {
+	var t, dt <-chan time.Time
 	var c *Conn
+	var start time.Time
 
 	if p.status.is(closing) {
 		return nil, ErrPoolClosed
@@ -202,10 +1055,35 @@ func (p *Pool) Get() (*Conn, error) {
 	select {
 	case c = <-p.conns:
 		goto gotone
+	default:
+	}
+	// Idle connections might be under observation, wait for them to be put back before spawning
+	p.observing.RLock()
+	select {
+	case c = <-p.conns:
+		p.observing.RUnlock()
+		goto gotone
 	default: // connections are running low, spawn a new one
-		if err := p.New(1); err != nil {
+		p.observing.RUnlock()
+		if p.connsCount.fetch() >= p.MaxConns {
+			p.events.emit(Saturated, nil, 0)
+		}
+		n, err := p.New(1)
+		if err != nil {
 			return nil, err
 		}
+		if n == 0 {
+			switch p.OnExhausted {
+			case FailOnExhaustion:
+				return nil, ErrPoolExhausted
+			case GrowOnExhaustion:
+				if c, err := p.growWithin(ctx, budget); c != nil || err != nil {
+					return c, err
+				}
+			}
+		} else if budget > 0 {
+			dt = time.After(budget)
+		}
 	}
 
 	// FIXME potential deadlock if the following conditions are met:
@@ -214,14 +1092,26 @@ func (p *Pool) Get() (*Conn, error) {
 	// - No more connections will be released successfully.
 	// - Garbage collection is triggered after New
 
-	if p.WaitTimeout > 0 {
-		t = time.After(p.WaitTimeout)
+	if d := p.waitTimeout(); d > 0 {
+		t = time.After(d)
 	}
+	start = time.Now()
+	atomic.AddInt32(&p.waiters, 1)
 	select {
 	case c = <-p.conns:
+		atomic.AddInt32(&p.waiters, -1)
+		p.events.emit(GetWaited, nil, time.Since(start))
 		goto gotone
 	case <-t:
+		atomic.AddInt32(&p.waiters, -1)
+		p.events.emit(GetTimedOut, nil, time.Since(start))
 		return nil, ErrOpTimeout
+	case <-dt:
+		atomic.AddInt32(&p.waiters, -1)
+		return nil, ErrOpTimeout
+	case <-ctx.Done():
+		atomic.AddInt32(&p.waiters, -1)
+		return nil, ctx.Err()
 	}
 
 gotone:
@@ -229,18 +1119,65 @@ gotone:
 		// Pool has been closed simultaneously
 		return nil, ErrPoolClosed
 	}
-	if !c.setActive() {
+	if c = p.dequeue(c); c == nil || !c.setActive() {
 		// Connection timed out, start over
-		return p.Get()
+		return p.getContext(ctx, budget)
 	}
 	// Test the connection
-	if err := p.Driver.TestOnBorrow(c); err != nil {
-		if !p.Driver.Temporary(err) {
+	if err := p.validate(c); err != nil {
+		if !p.driverOf(c).Temporary(err) {
 			p.stats.Inc("conns.fails", 1, sampleRate)
+			atomic.AddUint32(&p.badBorrows, 1)
 			p.gc <- c // garbage collect the connection and start over
-			return p.Get()
+			return p.getContext(ctx, budget)
 		}
 	}
+	p.checkout(c)
+	return c, nil
+}
+
+func (p *Pool) waitTimeout() time.Duration {
+	return p.wait.Load().(time.Duration)
+}
+
+// SetWaitTimeout changes the duration during which subsequent Get operations wait for a connection.
+// Note that the WaitTimeout of the pool configuration remains unchanged.
+func (p *Pool) SetWaitTimeout(d time.Duration) error {
+	if d < 0 {
+		return ErrInvalidArg
+	}
+	p.wait.Store(d)
+	return nil
+}
+
+// Like grow but gives up dialing after the given budget (unlimited if zero).
+func (p *Pool) growWithin(ctx context.Context, budget time.Duration) (*Conn, error) {
+	if budget <= 0 {
+		return p.grow(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	return p.grow(ctx)
+}
+
+// Dials a temporary connection beyond MaxConns, it returns nil if HardMaxConns is reached.
+func (p *Pool) grow(ctx context.Context) (*Conn, error) {
+	for {
+		n := atomic.LoadInt32(&p.bursts)
+		if p.MaxConns+n >= p.HardMaxConns {
+			return nil, nil
+		}
+		if atomic.CompareAndSwapInt32(&p.bursts, n, n+1) {
+			break
+		}
+	}
+	c, err := p.connect(ctx)
+	if c == nil {
+		atomic.AddInt32(&p.bursts, -1)
+		return nil, err
+	}
+	c.burst = true
+	p.checkout(c)
 	return c, nil
 }
 
@@ -254,16 +1191,209 @@ func (p *Pool) Put(c *Conn, e error) (bool, error) {
 	if c == nil {
 		return false, ErrInvalidArg
 	}
-	if e != nil && !p.Driver.Temporary(e) {
+	c.borrowed = false
+	if c.burst {
+		// Temporary connection, close it right away
+		down := e != nil && !p.driverOf(c).Temporary(e)
+		p.destroy(c)
+		atomic.AddInt32(&p.bursts, -1)
+		return down, nil
+	}
+	if e != nil && !p.driverOf(c).Temporary(e) {
 		p.stats.Inc("conns.fails", 1, sampleRate)
 		p.gc <- c
 		return true, nil
 	}
-	c.setIdle(p)
-	p.inbound.channel() <- c
+	if p.driverOf(c) != p.driver() || p.addressOf(c) != p.Address() {
+		if p.status.is(closing) {
+			p.gc <- c
+			return false, nil
+		}
+		// The driver or the address has been replaced, renew the connection in its slot
+		// XXX as dial does, so that the renewal can't be denied by MaxConns
+		p.destroy(c)
+		go p.do("new-conn", func() { p.dial(context.Background()) })
+		return false, nil
+	}
+	p.events.emit(ConnReturned, c, 0)
+	p.enqueue(c)
 	return false, nil
 }
 
+// Do gets a connection from the pool and calls fn with it, putting it back afterwards along with the error
+// returned by fn (see Put). It returns the error returned by fn or the error encountered while getting a connection.
+func (p *Pool) Do(fn func(*Conn) error) error {
+	return p.DoContext(context.Background(), fn)
+}
+
+// DoContext is like Do but gives up waiting for a connection when the given context is done.
+func (p *Pool) DoContext(ctx context.Context, fn func(*Conn) error) error {
+	c, err := p.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(c)
+	if _, e := p.Put(c, err); e != nil && err == nil {
+		return e
+	}
+	return err
+}
+
+// DoWithRetry gets a connection from the pool and calls fn with its underlying net.Conn (see Conn.NetConn),
+// putting it back afterwards. If fn fails with a fatal error (see Driver.Temporary), the connection is
+// garbage collected and fn is retried with another connection, up to ConnRetries times.
+// It returns the last error returned by fn or the error encountered while getting a connection.
+func (p *Pool) DoWithRetry(ctx context.Context, fn func(c net.Conn) error) error {
+	var err error
+
+	for i := 0; i <= p.ConnRetries; i++ {
+		var c *Conn
+
+		c, err = p.GetContext(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn(c.NetConn())
+		down, e := p.Put(c, err)
+		if e != nil {
+			return e
+		}
+		if !down {
+			return err // success or temporary failure
+		}
+	}
+	return err
+}
+
+// TestIdle tests all the idle connections concurrently (see Driver.TestOnBorrow) and garbage collects the ones
+// failing with a fatal error. Connections under test are not available to Get until TestIdle returns.
+// It returns the number of connections tested, the number of them garbage collected and the first error encountered.
+func (p *Pool) TestIdle() (tested, failed int, err error) {
+	var w sync.WaitGroup
+	var m sync.Mutex
+	var conns []*Conn
+
+	if p.status.is(closing) {
+		return 0, 0, ErrPoolClosed
+	}
+
+	p.observing.RLock()
+	for drained := false; !drained; {
+		select {
+		case c := <-p.conns:
+			if c == nil {
+				drained = true // pool closed simultaneously
+				continue
+			}
+			if c = p.dequeue(c); c != nil && c.setActive() {
+				conns = append(conns, c)
+			} // else connection timed out, it is already being garbage collected
+		default:
+			drained = true
+		}
+	}
+	p.observing.RUnlock()
+
+	workers := runtime.GOMAXPROCS(0)
+	if len(conns) < workers {
+		workers = len(conns)
+	}
+	queue := make(chan *Conn, len(conns))
+	for _, c := range conns {
+		queue <- c
+	}
+	close(queue)
+
+	w.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for c := range queue {
+				e := p.test(c)
+				fatal := e != nil && !p.driverOf(c).Temporary(e)
+				if fatal {
+					p.stats.Inc("conns.fails", 1, sampleRate)
+					p.gc <- c
+				} else {
+					p.enqueue(c)
+				}
+
+				m.Lock()
+				tested++
+				if fatal {
+					failed++
+				}
+				if e != nil && err == nil {
+					err = e
+				}
+				m.Unlock()
+			}
+			w.Done()
+		}()
+	}
+	w.Wait()
+	return
+}
+
+// GC forces the validation of the idle connections (see TestIdle), regardless of their idle timers,
+// and garbage collects the stale ones. It returns the number of connections garbage collected.
+func (p *Pool) GC() int {
+	_, n, _ := p.TestIdle()
+	return n
+}
+
+// TransferTo moves up to n idle connections from the pool to the destination pool without closing them.
+// Transferred connections are bound to the destination driver and show up in its events as dialed (see Events).
+// If the pools addresses differ (e.g. live resharding), transferred connections keep serving their original address
+// until they are put back, at which point they are renewed with the destination address (see SetAddress).
+// It returns the number of connections actually transferred, which is bounded by the idle connections
+// available and the destination MaxConns.
+func (p *Pool) TransferTo(dst *Pool, n int) (int, error) {
+	var i int
+
+	if dst == nil || dst == p || n < 0 {
+		return 0, ErrInvalidArg
+	}
+	if p.status.is(closing) || dst.status.is(closing) {
+		return 0, ErrPoolClosed
+	}
+
+	for i < n {
+		if !dst.connsCount.increment() {
+			break // destination is full
+		}
+
+		var c *Conn
+		p.observing.RLock()
+		select {
+		case c = <-p.conns:
+		default:
+		}
+		p.observing.RUnlock()
+		if c == nil {
+			// No more idle connections (or pool closed simultaneously)
+			dst.connsCount.decrement()
+			break
+		}
+		if c = p.dequeue(c); c == nil || !c.setActive() {
+			// Connection timed out, it is already being garbage collected
+			dst.connsCount.decrement()
+			continue
+		}
+
+		p.connsCount.decrement()
+		atomic.AddInt32(&p.connsUp, -1)
+		atomic.AddInt32(&dst.connsUp, 1)
+		c.id = dst.nextID() // IDs are unique within a pool
+		c.driver = dst.driver()
+		c.address = p.addressOf(c)
+		c.setPool(dst)
+		dst.events.emit(ConnDialed, c, 0)
+		dst.enqueue(c)
+		i++
+	}
+	return i, nil
+}
+
 // Close closes the pool, thus destroying all connections.
 // It returns when all spawned connections have been successfully garbage collected.
 // After a successful call to Close, the pool can not be used again.
@@ -273,7 +1403,9 @@ func (p *Pool) Close() error {
 	}
 
 	p.inbound.set(&p.gc)
-	p.status.set(closing)
+	if p.status.set(closing) {
+		p.stop()
+	}
 
 	// XXX wakeup the garbage collector if it happens to be asleep
 	// This is necessary when a Close is issued and there are no more connections left to collect
@@ -281,16 +1413,42 @@ func (p *Pool) Close() error {
 
 	// Garbage collect all the idle connections left
 	for c := range p.conns {
-		p.gc <- c
+		if c = p.dequeue(c); c != nil {
+			p.gc <- c
+		}
 	}
 	return nil
 }
 
+// Closes the pool right away, idle connections are destroyed while checked out ones are left unchanged.
+func (p *Pool) abort() {
+	p.inbound.set(&p.gc)
+	if p.status.set(closing) {
+		p.stop()
+	}
+	for drained := false; !drained; {
+		select {
+		case c := <-p.conns:
+			if c == nil {
+				return // pool closed simultaneously
+			}
+			if c = p.dequeue(c); c != nil && c.setActive() {
+				p.destroy(c)
+				p.connsCount.decrement()
+			}
+		default:
+			drained = true
+		}
+	}
+	p.ForceClose()
+}
+
 // ForceClose forces the termination of an ongoing Close operation.
 // It returns true if Close is interrupted successfully, false otherwise.
 // Note that all pending connections unacknowledged by Close will be left unchanged and won't ever be destroyed.
 func (p *Pool) ForceClose() bool {
 	if p.status.is(closing) && p.status.set(closed) {
+		p.stop()
 		close(p.conns)
 		p.gcCtl <- kill
 		return true
@@ -298,7 +1456,46 @@ func (p *Pool) ForceClose() bool {
 	return false
 }
 
+// Signals the teardown of the pool to its background routines (e.g. shrink), whichever of Close or ForceClose comes first.
+func (p *Pool) stop() {
+	p.quitOnce.Do(func() { close(p.quit) })
+}
+
+// SetAddress binds the pool to a new address (e.g. following a DNS change), idle connections are garbage collected
+// and renewed with the new address. Checked out connections keep working and are renewed once put back.
+// Pools managed by a service should be rebound with Service.Rebind instead.
+func (p *Pool) SetAddress(address string) error {
+	var n uint
+
+	if address == "" {
+		return ErrInvalidArg
+	}
+	if p.status.is(closing) {
+		return ErrPoolClosed
+	}
+	p.address.Store(address)
+
+	p.observing.RLock()
+	defer p.observing.RUnlock()
+	for drained := false; !drained; {
+		select {
+		case c := <-p.conns:
+			if c == nil {
+				return ErrPoolClosed // pool closed simultaneously
+			}
+			if c = p.dequeue(c); c != nil && c.setActive() {
+				p.gc <- c
+				n++
+			} // else connection timed out, it is already being garbage collected
+		default:
+			drained = true
+		}
+	}
+	_, err := p.New(n)
+	return err
+}
+
 // Address returns the address bound to the pool.
 func (p *Pool) Address() string {
-	return p.address
+	return p.address.Load().(string)
 }
@@ -1,9 +1,18 @@
 package pooly
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"runtime/pprof"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -268,6 +277,31 @@ func TestPoolForceClose(t *testing.T) {
 	c.NetConn().Close()
 }
 
+func TestPoolForceCloseShrink(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{
+		Driver:         nopDriver{},
+		ShrinkInterval: 5 * time.Millisecond,
+	})
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Close() // blocks on the connection checked out
+	waitUntil(t, func() bool { return p.status.is(closing) })
+	if !p.ForceClose() {
+		t.Fatal("forced close expected")
+	}
+
+	// The shrink routine is notified of the teardown
+	select {
+	case <-p.quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("teardown signaled expected")
+	}
+	p.driverOf(c).Close(c)
+}
+
 func TestPoolExhaustion(t *testing.T) {
 	e := newEchoServer(t, echo1)
 	defer e.close()
@@ -295,3 +329,1641 @@ func TestPoolExhaustion(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestPoolPprofLabels(t *testing.T) {
+	var b bytes.Buffer
+
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	p := NewPool(echo1, &PoolConfig{
+		ConnIdleTimeout:   1 * time.Second,
+		EnablePprofLabels: true,
+	})
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c, nil)
+	time.Sleep(1 * time.Millisecond) // wait for the idle timer to be scheduled
+
+	if err := pprof.Lookup("goroutine").WriteTo(&b, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, role := range []string{"gc", "idle-timer"} {
+		l := fmt.Sprintf(`"pool":"%s", "role":"%s"`, echo1, role)
+		if !strings.Contains(b.String(), l) {
+			t.Fatal("goroutine label expected:", l)
+		}
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolTransferTo(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	p := NewPool(echo1, nil)
+	dst := NewPool(echo1, nil)
+
+	events := dst.Events()
+
+	if _, err := p.BulkNew(2); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := p.TransferTo(dst, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatal("2 connections transferred expected, got", n)
+	}
+	if p.ActiveConns() != 0 || dst.ActiveConns() != 2 {
+		t.Fatal("bad active connections:", p.ActiveConns(), dst.ActiveConns())
+	}
+	for i := 0; i < n; i++ {
+		if ev := <-events; ev.Type != ConnDialed || ev.Conn.pool != dst {
+			t.Fatal("transferred connection dialed in the destination pool expected:", ev)
+		}
+	}
+
+	c, err := dst.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.pool != dst {
+		t.Fatal("connection bound to destination pool expected")
+	}
+	err = ping(c.NetConn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc := c.NetConn()
+	dst.Put(c, nil)
+
+	// Transferred connections are reused by the destination pool, not renewed
+	c, err = dst.GetWith(func(d *Conn) bool { return d.NetConn() == nc })
+	if err != nil {
+		t.Fatal("transferred connection still idle expected, got", err)
+	}
+	if c.isClosed() || c.NetConn() != nc {
+		t.Fatal("same underlying connection expected")
+	}
+	dst.Put(c, nil)
+	if dst.ActiveConns() != 2 {
+		t.Fatal("no connection renewed expected, got", dst.ActiveConns())
+	}
+
+	if _, err := p.TransferTo(p, 1); err != ErrInvalidArg {
+		t.Fatal("invalid argument expected")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolTransferToDistinctAddress(t *testing.T) {
+	e1 := newEchoServer(t, echo1)
+	defer e1.close()
+	e2 := newEchoServer(t, echo2)
+	defer e2.close()
+
+	p := NewPool(echo1, nil)
+	defer p.Close()
+	dst := NewPool(echo2, nil)
+	defer dst.Close()
+
+	if _, err := p.BulkNew(1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := p.TransferTo(dst, 1); err != nil || n != 1 {
+		t.Fatal("1 connection transferred expected, got", n, err)
+	}
+
+	// The transferred connection keeps serving its original address until put back
+	c, err := dst.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(c.NetConn()); err != nil {
+		t.Fatal(err)
+	}
+	if a := c.NetConn().RemoteAddr().String(); !strings.HasSuffix(a, ":7357") {
+		t.Fatal("connection to", echo1, "expected, got", a)
+	}
+	if _, err := dst.Put(c, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then it is renewed with the destination address
+	c, err = dst.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := c.NetConn().RemoteAddr().String(); !strings.HasSuffix(a, ":7358") {
+		t.Fatal("connection to", echo2, "expected, got", a)
+	}
+	dst.Put(c, nil)
+}
+
+func TestPoolBulkNew(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	p := NewPool(echo1, &PoolConfig{
+		MaxConns: 5,
+	})
+
+	n, err := p.BulkNew(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 || p.ActiveConns() != 5 {
+		t.Fatal("5 connections spawned expected, got", n)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.BulkNew(1); err != ErrPoolClosed {
+		t.Fatal("closed pool expected")
+	}
+}
+
+func TestPoolBulkNewFailed(t *testing.T) {
+	p := NewPool(echo1, nil) // no server listening
+
+	n, err := p.BulkNew(2)
+	if n != 0 || err == nil {
+		t.Fatal("dialing error expected")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func benchmarkPoolNew(b *testing.B, spawn func(*Pool)) {
+	e := newEchoServer(b, echo1)
+	defer e.close()
+
+	for i := 0; i < b.N; i++ {
+		p := NewPool(echo1, &PoolConfig{MaxConns: 100})
+		spawn(p)
+		for len(p.conns) < 100 {
+			time.Sleep(100 * time.Microsecond)
+		}
+		p.Close()
+	}
+}
+
+func BenchmarkPoolNew(b *testing.B) {
+	benchmarkPoolNew(b, func(p *Pool) { p.New(100) })
+}
+
+func BenchmarkPoolBulkNew(b *testing.B) {
+	benchmarkPoolNew(b, func(p *Pool) { p.BulkNew(100) })
+}
+
+func TestPoolDo(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	p := NewPool(echo1, nil)
+
+	var conn *Conn
+	err := p.Do(func(c *Conn) error {
+		conn = c
+		return ping(c.NetConn())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.IdleConns() != 1 || conn.isClosed() {
+		t.Fatal("connection put back expected")
+	}
+
+	events := p.Events()
+	failure := errors.New("") // fake a fatal operation failure
+	err = p.Do(func(c *Conn) error {
+		conn = c
+		return failure
+	})
+	if err != failure {
+		t.Fatal("fn error expected, got", err)
+	}
+	waitCollected(t, events, conn)
+	if p.IdleConns() != 0 || !conn.isClosed() {
+		t.Fatal("connection garbage collected expected")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Do(func(*Conn) error { return nil }); err != ErrPoolClosed {
+		t.Fatal("pool closed error expected")
+	}
+}
+
+func benchmarkPoolGetPut(b *testing.B, policy EvictionPolicy) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}, EvictionPolicy: policy})
+	defer p.Close()
+
+	p.New(10)
+	time.Sleep(1 * time.Millisecond) // wait for connections to be spawned
+	b.ResetTimer()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c, err := p.Get()
+		if err != nil {
+			b.Fatal(err)
+		}
+		p.Put(c, nil)
+	}
+}
+
+func BenchmarkPoolGetPut(b *testing.B)    { benchmarkPoolGetPut(b, FIFOEviction) }
+func BenchmarkPoolGetPutLRU(b *testing.B) { benchmarkPoolGetPut(b, LRUEviction) }
+
+func BenchmarkPoolDo(b *testing.B) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}})
+	defer p.Close()
+
+	fn := func(*Conn) error { return nil }
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := p.Do(fn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPoolTestIdle(t *testing.T) {
+	var conns []*Conn
+
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	p := NewPool(echo1, &PoolConfig{
+		Driver:   testDriver,
+		MaxConns: 4,
+	})
+
+	for i := 0; i < 4; i++ {
+		c, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for i, c := range conns {
+		if i%2 == 0 {
+			c.NetConn().Close() // close the underlying connection
+		}
+		p.Put(c, nil)
+	}
+
+	tested, failed, err := p.TestIdle()
+	if tested != 4 || failed != 2 || err == nil {
+		t.Fatal("2 failures out of 4 tests expected, got", failed, tested, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		c := p.dequeue(<-p.conns) // bypass TestOnBorrow
+		if err := ping(c.NetConn()); err != nil {
+			t.Fatal(err)
+		}
+		c.setActive()
+		p.Put(c, nil)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolGC(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: &halfBadDriver{}, MaxConns: 4})
+
+	for i := 0; i < 4; i++ {
+		if _, err := p.spawn(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := p.GC(); n != 2 {
+		t.Fatal("2 connections garbage collected expected, got", n)
+	}
+	if n := p.IdleConns(); n != 2 {
+		t.Fatal("2 idle connections expected, got", n)
+	}
+	for p.ActiveConns() != 2 {
+		time.Sleep(1 * time.Millisecond) // wait for the garbage collection
+	}
+	if n := p.GC(); n != 1 {
+		t.Fatal("1 connection garbage collected expected, got", n)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.GC(); n != 0 {
+		t.Fatal("no garbage collection expected on a closed pool, got", n)
+	}
+}
+
+func TestPoolDialRateLimit(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{
+		Driver:        nopDriver{},
+		DialRateLimit: 10,
+		DialBurst:     1,
+	})
+
+	start := time.Now()
+	if n, err := p.BulkNew(20); n != 20 || err != nil {
+		t.Fatal("20 connections spawned expected, got", n, err)
+	}
+	if d := time.Since(start); d < 1900*time.Millisecond {
+		t.Fatal("dials throttling expected, took", d)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type closeCountingDriver struct {
+	*NetDriver
+	closed int32
+}
+
+func (d *closeCountingDriver) Close(c *Conn) {
+	atomic.AddInt32(&d.closed, 1)
+	d.NetDriver.Close(c)
+}
+
+func TestPoolSetDriver(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	old := &closeCountingDriver{NetDriver: NewNetDriver("tcp")}
+	next := &closeCountingDriver{NetDriver: NewNetDriver("tcp")}
+
+	p := NewPool(echo1, &PoolConfig{
+		Driver: old,
+	})
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetDriver(next); err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c, nil)
+	time.Sleep(1 * time.Millisecond) // wait for garbage collection
+
+	if atomic.LoadInt32(&old.closed) != 1 {
+		t.Fatal("connection closed by the old driver expected")
+	}
+
+	d, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == c || d.Driver() != next {
+		t.Fatal("connection created by the new driver expected")
+	}
+	if err := ping(d.NetConn()); err != nil {
+		t.Fatal(err)
+	}
+	p.Put(d, nil)
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&next.closed) == 0 {
+		t.Fatal("connections closed by the new driver expected")
+	}
+	if err := p.SetDriver(old); err != ErrPoolClosed {
+		t.Fatal("closed pool expected")
+	}
+}
+
+func TestPoolSetDriverMaxConns(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	next := &closeCountingDriver{NetDriver: NewNetDriver("tcp")}
+	p := NewPool(echo1, &PoolConfig{
+		Driver:   &closeCountingDriver{NetDriver: NewNetDriver("tcp")},
+		MaxConns: 1,
+	})
+	defer p.Close()
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetDriver(next); err != nil {
+		t.Fatal(err)
+	}
+	events := p.Events()
+	p.Put(c, nil)
+	waitCollected(t, events, c)
+
+	// The connection is renewed in its slot despite MaxConns being reached
+	waitUntil(t, func() bool { return p.IdleConns() == 1 })
+	d, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Driver() != next || p.ActiveConns() != 1 {
+		t.Fatal("connection renewed with the new driver expected")
+	}
+	p.Put(d, nil)
+}
+
+func TestPoolSetDriverTemporary(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}})
+	defer p.Close()
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetDriver(&halfBadDriver{}); err != nil {
+		t.Fatal(err)
+	}
+	// The error is temporary for the driver the connection was created with
+	down, err := p.Put(c, errors.New("timeout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if down {
+		t.Fatal("temporary error expected")
+	}
+}
+
+func TestPoolConnIdleSliding(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	for _, fixed := range []bool{false, true} {
+		p := NewPool(echo1, &PoolConfig{
+			ConnIdleTimeout: 50 * time.Millisecond,
+			FixedIdle:       fixed,
+		})
+		events := p.Events()
+
+		c, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(60 * time.Millisecond) // in use past the idle timeout
+		p.Put(c, nil)
+		if fixed {
+			waitCollected(t, events, c) // idle countdown started at creation, already expired
+		}
+
+		d, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Put(d, nil)
+		if !fixed && c != d {
+			t.Fatal("connections match expected with sliding idle")
+		}
+		if fixed && c == d {
+			t.Fatal("connections mismatch expected with fixed idle")
+		}
+
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPoolDoWithRetry(t *testing.T) {
+	var calls int
+
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	p := NewPool(echo1, nil)
+
+	err := p.DoWithRetry(context.Background(), func(c net.Conn) error {
+		if calls++; calls == 1 {
+			return errors.New("") // fake a fatal operation failure
+		}
+		return ping(c)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatal("1 retry expected, got", calls-1)
+	}
+	time.Sleep(1 * time.Millisecond) // wait for garbage collection
+	if n := len(p.conns); n != int(p.ActiveConns()) {
+		t.Fatal("connections put back to the pool expected:", n, p.ActiveConns())
+	}
+
+	calls = 0
+	err = p.DoWithRetry(context.Background(), func(c net.Conn) error {
+		calls++
+		return errors.New("") // fake a fatal operation failure
+	})
+	if err == nil || calls != p.ConnRetries+1 {
+		t.Fatal("retries exhausted expected, got", calls, err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolEvents(t *testing.T) {
+	var saturated, timedout bool
+
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	p := NewPool(echo1, &PoolConfig{
+		WaitTimeout: 10 * time.Millisecond,
+		MaxConns:    1,
+	})
+	events := p.Events()
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get(); err != ErrOpTimeout {
+		t.Fatal("timeout expected")
+	}
+	p.Put(c, nil)
+
+	for len(events) > 0 {
+		switch e := <-events; e.Type {
+		case Saturated:
+			saturated = true
+		case GetTimedOut:
+			timedout = e.Wait >= p.WaitTimeout
+		}
+	}
+	if !saturated || !timedout {
+		t.Fatal("saturation and timeout events expected")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolEventsConns(t *testing.T) {
+	var types []PoolEventType
+
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	p := NewPool(echo1, nil)
+	events := p.Events()
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c, nil)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for len(types) == 0 || types[len(types)-1] != ConnClosed {
+		select {
+		case e := <-events:
+			if e.Conn == nil {
+				continue // not a connection event (e.g. GetWaited)
+			}
+			if e.Conn != c {
+				t.Fatal("bad connection event:", e)
+			}
+			types = append(types, e.Type)
+		case <-timeout:
+			t.Fatal("connection not collected in time:", types)
+		}
+	}
+	expected := []PoolEventType{ConnDialed, ConnCheckedOut, ConnReturned, ConnClosed}
+	if fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Fatal("bad connection events:", types)
+	}
+}
+
+func TestPoolNewWithContext(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{ // no server listening
+		MaxConns:    2,
+		ConnRetries: 100,
+		RetryDelay:  10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n, err := p.NewWithContext(ctx, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatal("2 connections spawned expected, got", n)
+	}
+	time.Sleep(5 * time.Millisecond) // wait for dials to start
+	if n := p.ActiveConns(); n > p.MaxConns {
+		t.Fatal("too many connections:", n)
+	}
+
+	cancel()
+	time.Sleep(5 * time.Millisecond) // wait for dials to be given up
+	if n := p.ActiveConns(); n != 0 {
+		t.Fatal("no connection expected, got", n)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type idleTimeoutDriver struct {
+	*NetDriver
+	timeout time.Duration
+}
+
+func (d *idleTimeoutDriver) Dial(address string) (*Conn, error) {
+	c, err := d.NetDriver.Dial(address)
+	if c != nil {
+		c.SetIdleTimeout(d.timeout) // fake a server-announced limit
+	}
+	return c, err
+}
+
+func TestPoolConnIdleOverride(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	p := NewPool(echo1, &PoolConfig{
+		Driver: &idleTimeoutDriver{NewNetDriver("tcp"), 10 * time.Millisecond},
+	})
+	events := p.Events()
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c, nil)
+	waitCollected(t, events, c) // idle timeout overridden by the driver expired
+
+	d, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(d, nil)
+	if c == d {
+		t.Fatal("connections mismatch expected")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolNewSpawned(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	p := NewPool(echo1, &PoolConfig{MaxConns: 3})
+
+	if n, err := p.New(2); err != nil || n != 2 {
+		t.Fatal("2 connections spawned expected, got", n, err)
+	}
+	if n, err := p.New(2); err != nil || n != 1 {
+		t.Fatal("1 connection spawned expected, got", n, err)
+	}
+	if n, err := p.New(1); err != nil || n != 0 {
+		t.Fatal("no connection spawned expected, got", n, err)
+	}
+	time.Sleep(5 * time.Millisecond) // wait for connections to be spawned
+	if n := p.ActiveConns(); n != 3 {
+		t.Fatal("3 connections expected, got", n)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.New(1); err != ErrPoolClosed {
+		t.Fatal("pool closed error expected")
+	}
+}
+
+func TestPoolConnectionIDs(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	p := NewPool(echo1, nil)
+
+	if _, err := p.New(3); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond) // wait for connections to be spawned
+	ids := p.ConnectionIDs()
+	if len(ids) != 3 || ids[0] == 0 || ids[0] == ids[1] || ids[1] == ids[2] {
+		t.Fatal("3 unique connection IDs expected, got", ids)
+	}
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := c.ID()
+	for _, i := range p.ConnectionIDs() {
+		if i == id {
+			t.Fatal("borrowed connection reported idle")
+		}
+	}
+	if n := len(p.ConnectionIDs()); n != 2 {
+		t.Fatal("2 idle connections expected, got", n)
+	}
+
+	if _, err := p.Put(c, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(p.ConnectionIDs()) != fmt.Sprint(ids) {
+		t.Fatal("IDs preserved across Put/Get expected:", p.ConnectionIDs())
+	}
+	if c.ID() != id {
+		t.Fatal("connection ID changed")
+	}
+	if NewConn(nil).ID() != 0 {
+		t.Fatal("no ID expected on detached connection")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.ConnectionIDs()); n != 0 {
+		t.Fatal("no idle connection expected after close, got", n)
+	}
+}
+
+func TestPoolGetByID(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}})
+	defer p.Close()
+	q := NewPool(echo2, &PoolConfig{Driver: nopDriver{}})
+	defer q.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.spawn(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.spawn(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ids := q.ConnectionIDs(); len(ids) != 1 || ids[0] != 1 {
+		t.Fatal("IDs unique within a pool expected, got", ids)
+	}
+
+	ids := p.ConnectionIDs()
+	c := p.getByID(ids[1])
+	if c == nil || c.ID() != ids[1] {
+		t.Fatal("connection", ids[1], "expected")
+	}
+	if p.getByID(ids[1]) != nil {
+		t.Fatal("borrowed connection handed out twice")
+	}
+
+	// The other connections are handed out in order
+	for _, id := range []uint64{ids[0], ids[2]} {
+		d, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.ID() != id {
+			t.Fatal("connection", id, "expected, got", d.ID())
+		}
+		defer p.Put(d, nil)
+	}
+	p.Put(c, nil)
+}
+
+func TestPoolCapacityUsedPercent(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}, MaxConns: 4})
+
+	if pct := p.CapacityUsedPercent(); pct != 0 {
+		t.Fatal("0% expected, got", pct)
+	}
+	p.New(2)
+	if pct := p.CapacityUsedPercent(); pct != 50 {
+		t.Fatal("50% expected, got", pct)
+	}
+	p.New(2)
+	if pct := p.CapacityUsedPercent(); pct != 100 {
+		t.Fatal("100% expected, got", pct)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolLen(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}})
+
+	p.New(3)
+	if p.Len() != 3 || p.Len() != int(p.ActiveConns()) {
+		t.Fatal("3 connections expected, got", p.Len())
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tagDriver tags every other connection it spawns.
+type tagDriver struct {
+	nopDriver
+	dials *int32
+}
+
+func (d tagDriver) Dial(a string) (*Conn, error) {
+	c, err := d.nopDriver.Dial(a)
+	if atomic.AddInt32(d.dials, 1)%2 == 1 {
+		c.SetTags(1)
+	}
+	return c, err
+}
+
+func TestPoolGetWith(t *testing.T) {
+	var dials int32
+
+	p := NewPool(echo1, &PoolConfig{
+		Driver:   tagDriver{dials: &dials},
+		MaxConns: 4,
+	})
+	tagged := func(c *Conn) bool { return c.HasTags(1) }
+
+	p.New(4)
+	time.Sleep(1 * time.Millisecond) // wait for connections to be spawned
+
+	var conns []*Conn
+	for i := 0; i < 3; i++ {
+		c, err := p.GetWith(tagged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tagged(c) {
+			t.Fatal("tagged connection expected")
+		}
+		conns = append(conns, c)
+	}
+	if n := atomic.LoadInt32(&dials); n != 5 {
+		t.Fatal("an untagged connection replaced expected, got", n, "dials")
+	}
+	if p.ActiveConns() != 4 || p.IdleConns() != 1 {
+		t.Fatal("MaxConns exceeded")
+	}
+
+	// No connection ever satisfies the predicate
+	if _, err := p.GetWith(func(c *Conn) bool { return false }); err != ErrNoMatchingConn {
+		t.Fatal("no matching connection error expected, got", err)
+	}
+
+	for _, c := range conns {
+		p.Put(c, nil)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolEvictionPolicy(t *testing.T) {
+	order := func(policy EvictionPolicy) (ids []uint64) {
+		p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}, EvictionPolicy: policy})
+		defer p.Close()
+
+		var conns []*Conn
+		for i := 0; i < 3; i++ {
+			c, err := p.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, c)
+		}
+		for _, c := range conns {
+			p.Put(c, nil)
+		}
+		for i := 0; i < 3; i++ {
+			c, err := p.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, c.ID())
+			defer p.Put(c, nil)
+		}
+		if len(p.ConnectionIDs()) != 0 {
+			t.Fatal("no idle connection expected")
+		}
+		for _, c := range conns {
+			ids = append(ids, c.ID()) // order of return
+		}
+		return
+	}
+
+	fifo := order(FIFOEviction)
+	if fifo[0] != fifo[3] || fifo[1] != fifo[4] || fifo[2] != fifo[5] {
+		t.Fatal("first returned connection handed out first expected:", fifo)
+	}
+	lru := order(LRUEviction)
+	if lru[0] != lru[5] || lru[1] != lru[4] || lru[2] != lru[3] {
+		t.Fatal("last returned connection handed out first expected:", lru)
+	}
+}
+
+func TestPoolEvictionRoundRobin(t *testing.T) {
+	const n, m = 100, 4
+
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}, MaxConns: m, EvictionPolicy: RoundRobinEviction})
+	defer p.Close()
+
+	for i := 0; i < m; i++ {
+		if _, err := p.spawn(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Put connections back out of order, they must be handed out in turn nonetheless
+	uses := make(map[uint64]int)
+	for i := 0; i < n; i += 2 {
+		c1, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		uses[c1.ID()]++
+		uses[c2.ID()]++
+		p.Put(c2, nil)
+		p.Put(c1, nil)
+	}
+	if len(uses) != m {
+		t.Fatal(m, "connections used expected, got", len(uses))
+	}
+	for id, u := range uses {
+		if u != n/m {
+			t.Fatal("connection", id, "used", n/m, "times expected, got", u)
+		}
+	}
+}
+
+func TestPoolEvictionLRUIdle(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{
+		Driver:          nopDriver{},
+		EvictionPolicy:  LRUEviction,
+		ConnIdleTimeout: 10 * time.Millisecond,
+	})
+
+	p.New(3)
+	waitUntil(t, func() bool { return p.ActiveConns() == 0 }) // connections timed out and garbage collected
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.isClosed() {
+		t.Fatal("live connection expected")
+	}
+	p.Put(c, nil)
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolWaiters(t *testing.T) {
+	var w sync.WaitGroup
+
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}, MaxConns: 1})
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Waiters() != 0 {
+		t.Fatal("no waiter expected")
+	}
+
+	w.Add(3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			defer w.Done()
+			c, err := p.Get()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			p.Put(c, nil)
+		}()
+	}
+	time.Sleep(5 * time.Millisecond) // wait for the routines to block
+	if n := p.Waiters(); n != 3 {
+		t.Fatal("3 waiters expected, got", n)
+	}
+	if h := newTestHost(p); h.Stats().Waiters != 3 {
+		t.Fatal("waiters reported in host stats expected")
+	}
+
+	p.Put(c, nil)
+	w.Wait()
+	if n := p.Waiters(); n != 0 {
+		t.Fatal("no waiter expected, got", n)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolWaitEmpty(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}})
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Put(c, nil)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.WaitEmpty(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.WaitEmpty(ctx); err != context.DeadlineExceeded {
+		t.Fatal("deadline exceeded expected, got", err)
+	}
+	p.Put(c, nil)
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolWaitEmptyIdleTimeout(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}, ConnIdleTimeout: 20 * time.Millisecond})
+	defer p.Close()
+
+	events := p.Events()
+	if _, err := p.New(2); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for n := 0; n < 2; { // wait for the connections to time out
+		select {
+		case e := <-events:
+			if e.Type == ConnClosed {
+				n++
+			}
+		case <-timeout:
+			t.Fatal("connections not collected in time")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.WaitEmpty(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolIntrospect(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}})
+	defer p.Close()
+
+	if _, err := p.New(3); err != nil {
+		t.Fatal(err)
+	}
+	for p.IdleConns() != 3 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	out := p.Introspect()
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 {
+		t.Fatal("header and 3 rows expected, got:\n" + out)
+	}
+	header := strings.Fields(strings.Replace(lines[0], "|", " ", -1))
+	if strings.Join(header, " ") != "ID State Age IdleSince TestStatus" {
+		t.Fatal("bad header:", lines[0])
+	}
+	for _, l := range lines[1:] {
+		if !strings.Contains(l, "idle") || !strings.Contains(l, "untested") {
+			t.Fatal("idle row expected:", l)
+		}
+	}
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = p.Introspect()
+	if !strings.Contains(out, "[checked out #1]") || strings.Count(out, "\n") != 4 {
+		t.Fatal("2 rows and 1 checked out connection expected, got:\n" + out)
+	}
+	p.Put(c, nil)
+	if !strings.Contains(p.Introspect(), "ok") {
+		t.Fatal("tested connection expected")
+	}
+}
+
+type countingDriver struct {
+	nopDriver
+	tests int32
+}
+
+func (d *countingDriver) TestOnBorrow(*Conn) error {
+	atomic.AddInt32(&d.tests, 1)
+	return nil
+}
+
+func TestPoolValidationGracePeriod(t *testing.T) {
+	d := &countingDriver{}
+	p := NewPool(echo1, &PoolConfig{Driver: d, ValidationGracePeriod: 20 * time.Millisecond})
+	defer p.Close()
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c, nil)
+
+	// Recently used, validation is skipped
+	c, err = p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&d.tests); n != 0 {
+		t.Fatal("no validation expected, got", n)
+	}
+	p.Put(c, nil)
+
+	// Idle for too long, validation is performed
+	time.Sleep(30 * time.Millisecond)
+	c, err = p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&d.tests); n != 1 {
+		t.Fatal("one validation expected, got", n)
+	}
+	p.Put(c, nil)
+}
+
+func TestPoolShrinkIdle(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}})
+	defer p.Close()
+
+	if _, err := p.New(10); err != nil {
+		t.Fatal(err)
+	}
+	for p.IdleConns() != 10 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	if n := p.ShrinkIdle(5); n != 5 {
+		t.Fatal("5 connections closed expected, got", n)
+	}
+	if n := p.IdleConns(); n > 5 {
+		t.Fatal("at most 5 idle connections expected, got", n)
+	}
+	if n := p.ShrinkIdle(10); n != 5 {
+		t.Fatal("remaining 5 connections closed expected, got", n)
+	}
+}
+
+func TestPoolShrinkInterval(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{
+		Driver:         nopDriver{},
+		ShrinkInterval: 5 * time.Millisecond,
+		ShrinkTarget:   2,
+	})
+	defer p.Close()
+
+	if _, err := p.New(6); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for p.ActiveConns() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("pool shrunk to 2 connections expected, got", p.ActiveConns())
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+type layeredConn struct {
+	conn net.Conn
+}
+
+func (l *layeredConn) Unwrap() net.Conn { return l.conn }
+
+func TestConnNetConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	if NewConn(c1).NetConn() != c1 {
+		t.Fatal("net.Conn expected")
+	}
+	if NewConn(&layeredConn{c1}).NetConn() != c1 {
+		t.Fatal("unwrapped net.Conn expected")
+	}
+	if NewConn(struct{}{}).NetConn() != nil {
+		t.Fatal("nil expected for a non net.Conn")
+	}
+	if NewConn(nil).NetConn() != nil {
+		t.Fatal("nil expected for a nil interface")
+	}
+}
+
+func TestMultiConnNotNetConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+
+	m := MultiConn{NewConn(c1), NewConn(struct{}{})}
+	if _, err := m.WriteAll([]byte("ping")); err != ErrNotNetConn {
+		t.Fatal("not a net.Conn error expected, got", err)
+	}
+}
+
+type halfBadDriver struct {
+	nopDriver
+	n int32
+}
+
+func (d *halfBadDriver) TestOnBorrow(*Conn) error {
+	if atomic.AddInt32(&d.n, 1)%2 == 0 {
+		return errors.New("misconfigured")
+	}
+	return nil
+}
+
+func (d *halfBadDriver) Temporary(error) bool { return false }
+
+func TestPoolWarmAndTest(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: &halfBadDriver{}})
+	defer p.Close()
+
+	ok, failed, err := p.WarmAndTest(context.Background(), 10)
+	if err == nil {
+		t.Fatal("test error expected")
+	}
+	if ok != 5 || failed != 5 {
+		t.Fatal("5 connections ok and 5 failed expected:", ok, failed)
+	}
+	if n := p.IdleConns(); n != 5 {
+		t.Fatal("5 idle connections expected, got", n)
+	}
+	for p.ActiveConns() != 5 {
+		time.Sleep(1 * time.Millisecond) // wait for the garbage collection
+	}
+}
+
+type flakyDriver struct {
+	halfBadDriver
+}
+
+func (d *flakyDriver) Temporary(error) bool { return true }
+
+func TestPoolWarmAndTestTemporary(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: &flakyDriver{}})
+	defer p.Close()
+
+	ok, failed, err := p.WarmAndTest(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != 10 || failed != 0 {
+		t.Fatal("10 connections ok expected:", ok, failed)
+	}
+	if n := p.IdleConns(); n != 10 {
+		t.Fatal("10 idle connections expected, got", n)
+	}
+}
+
+func TestPoolOnGet(t *testing.T) {
+	var fresh []bool
+
+	p := NewPool(echo1, &PoolConfig{
+		Driver:   nopDriver{},
+		MaxConns: 1,
+		OnGet:    func(c *Conn, f bool) { fresh = append(fresh, f) },
+	})
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		c, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Put(c, nil)
+	}
+	if len(fresh) != 3 || !fresh[0] || fresh[1] || fresh[2] {
+		t.Fatal("fresh connection then reused ones expected:", fresh)
+	}
+}
+
+func TestPoolSetAddress(t *testing.T) {
+	e1 := newEchoServer(t, echo1)
+	defer e1.close()
+	e2 := newEchoServer(t, echo2)
+	defer e2.close()
+
+	p := NewPool(echo1, nil)
+
+	old, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetAddress(""); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+	if err := p.SetAddress(echo2); err != nil {
+		t.Fatal(err)
+	}
+	if p.Address() != echo2 {
+		t.Fatal("new address expected")
+	}
+
+	// New connections dial the new address
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(c.NetConn().RemoteAddr().String(), ":7358") { // echo2
+		t.Fatal("connection to the new address expected")
+	}
+	p.Put(c, nil)
+
+	// Connections checked out beforehand keep working until put back
+	if err := ping(old.NetConn()); err != nil {
+		t.Fatal(err)
+	}
+	events := p.Events()
+	p.Put(old, nil)
+	waitCollected(t, events, old)
+	if !old.isClosed() {
+		t.Fatal("connection to the old address closed expected")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetAddress(echo1); err != ErrPoolClosed {
+		t.Fatal("pool closed error expected")
+	}
+}
+
+func TestPoolSetAddressWhileDialing(t *testing.T) {
+	gate, dialing := make(chan struct{}), make(chan struct{})
+	p := NewPool(echo1, &PoolConfig{Driver: gatedDriver{address: echo1, gate: gate, dialing: dialing}})
+	defer p.Close()
+
+	p.New(1)
+	<-dialing
+	if err := p.SetAddress(echo2); err != nil {
+		t.Fatal(err)
+	}
+	close(gate)
+
+	// The connection dialed to the old address is renewed in its slot
+	waitUntil(t, func() bool { return p.IdleConns() == 1 })
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.address != echo2 || p.ActiveConns() != 1 {
+		t.Fatal("single connection to the new address expected:", c.address, p.ActiveConns())
+	}
+	p.Put(c, nil)
+}
+
+func TestPoolOnExhausted(t *testing.T) {
+	saturate := func(policy ExhaustionPolicy, timeout time.Duration) (*Pool, *Conn) {
+		p := NewPool(echo1, &PoolConfig{
+			Driver:       nopDriver{},
+			MaxConns:     1,
+			HardMaxConns: 2,
+			WaitTimeout:  timeout,
+			OnExhausted:  policy,
+		})
+		c, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p, c
+	}
+
+	// WaitOnExhaustion
+	p, c := saturate(WaitOnExhaustion, 10*time.Millisecond)
+	if _, err := p.Get(); err != ErrOpTimeout {
+		t.Fatal("timeout error expected, got", err)
+	}
+	p.Put(c, nil)
+	p.Close()
+
+	// FailOnExhaustion
+	// The connection is only put back once Get returned, waiting for it would thus block until the (long) timeout
+	p, c = saturate(FailOnExhaustion, time.Hour)
+	done := make(chan error)
+	go func() {
+		_, err := p.Get()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrPoolExhausted {
+			t.Fatal("pool exhausted error expected, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("immediate failure expected")
+	}
+	p.Put(c, nil)
+	p.Close()
+
+	// GrowOnExhaustion
+	p, c = saturate(GrowOnExhaustion, 10*time.Millisecond)
+	b, err := p.Get()
+	if err != nil {
+		t.Fatal("temporary connection expected, got", err)
+	}
+	if _, err := p.Get(); err != ErrOpTimeout {
+		t.Fatal("timeout error expected past HardMaxConns, got", err)
+	}
+	p.Put(b, nil)
+	if !b.isClosed() {
+		t.Fatal("temporary connection closed expected")
+	}
+	if p.ActiveConns() != 1 {
+		t.Fatal("MaxConns connections expected, got", p.ActiveConns())
+	}
+	p.Put(c, nil)
+	p.Close()
+}
+
+type mockNetConn struct {
+	calls []string
+}
+
+type mockAddr string
+
+func (a mockAddr) Network() string { return "mock" }
+func (a mockAddr) String() string  { return string(a) }
+
+func (m *mockNetConn) record(call string) { m.calls = append(m.calls, call) }
+
+func (m *mockNetConn) Read(b []byte) (int, error)       { m.record("Read"); return len(b), nil }
+func (m *mockNetConn) Write(b []byte) (int, error)      { m.record("Write"); return len(b), nil }
+func (m *mockNetConn) Close() error                     { m.record("Close"); return nil }
+func (m *mockNetConn) LocalAddr() net.Addr              { m.record("LocalAddr"); return mockAddr("local") }
+func (m *mockNetConn) RemoteAddr() net.Addr             { m.record("RemoteAddr"); return mockAddr("remote") }
+func (m *mockNetConn) SetDeadline(time.Time) error      { m.record("SetDeadline"); return nil }
+func (m *mockNetConn) SetReadDeadline(time.Time) error  { m.record("SetReadDeadline"); return nil }
+func (m *mockNetConn) SetWriteDeadline(time.Time) error { m.record("SetWriteDeadline"); return nil }
+
+func TestConnNetConnInterface(t *testing.T) {
+	m := &mockNetConn{}
+	var c net.Conn = NewConn(m)
+
+	b := make([]byte, 4)
+	if n, err := c.Read(b); n != 4 || err != nil {
+		t.Fatal("read expected")
+	}
+	if n, err := c.Write(b); n != 4 || err != nil {
+		t.Fatal("write expected")
+	}
+	if c.LocalAddr().String() != "local" || c.RemoteAddr().String() != "remote" {
+		t.Fatal("addresses expected")
+	}
+	if c.SetDeadline(time.Now()) != nil || c.SetReadDeadline(time.Now()) != nil || c.SetWriteDeadline(time.Now()) != nil {
+		t.Fatal("deadlines expected")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	calls := "Read Write LocalAddr RemoteAddr SetDeadline SetReadDeadline SetWriteDeadline Close"
+	if strings.Join(m.calls, " ") != calls {
+		t.Fatal("delegated calls expected:", m.calls)
+	}
+
+	c = NewConn(struct{}{})
+	if _, err := c.Read(b); err != ErrNotNetConn {
+		t.Fatal("not a net.Conn error expected")
+	}
+	if _, err := c.Write(b); err != ErrNotNetConn {
+		t.Fatal("not a net.Conn error expected")
+	}
+	if c.LocalAddr() != nil || c.RemoteAddr() != nil {
+		t.Fatal("nil addresses expected")
+	}
+	if c.SetDeadline(time.Now()) != ErrNotNetConn || c.SetReadDeadline(time.Now()) != ErrNotNetConn ||
+		c.SetWriteDeadline(time.Now()) != ErrNotNetConn || c.Close() != ErrNotNetConn {
+		t.Fatal("not a net.Conn errors expected")
+	}
+}
+
+func TestPoolObserveConns(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}})
+	defer p.Close()
+
+	if _, err := p.New(5); err != nil {
+		t.Fatal(err)
+	}
+	for p.IdleConns() != 5 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	ids := p.ConnectionIDs()
+
+	var seen []uint64
+	p.ObserveConns(func(idle []*Conn) {
+		if p.IdleConns() != 0 {
+			t.Error("idle connections taken out expected")
+		}
+		for _, c := range idle {
+			seen = append(seen, c.ID())
+		}
+	})
+	sort.Slice(seen, func(i, j int) bool { return seen[i] < seen[j] })
+	if fmt.Sprint(seen) != fmt.Sprint(ids) {
+		t.Fatal("all idle connections observed expected:", seen, ids)
+	}
+
+	if p.IdleConns() != 5 || p.ActiveConns() != 5 {
+		t.Fatal("connections put back expected")
+	}
+	for i := 0; i < 5; i++ {
+		c, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.isClosed() {
+			t.Fatal("valid connection expected")
+		}
+		defer p.Put(c, nil)
+	}
+	if p.ActiveConns() != 5 {
+		t.Fatal("no new connection expected")
+	}
+}
+
+func TestPoolObserveConnsShrink(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}})
+	defer p.Close()
+
+	if _, err := p.New(5); err != nil {
+		t.Fatal(err)
+	}
+	for p.IdleConns() != 5 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	shrunk := make(chan int)
+	p.ObserveConns(func(idle []*Conn) {
+		go func() { shrunk <- p.ShrinkIdle(5) }()
+		select {
+		case <-shrunk:
+			t.Error("shrink waiting for the observation expected")
+		case <-time.After(10 * time.Millisecond):
+		}
+	})
+	if n := <-shrunk; n != 5 {
+		t.Fatal("5 idle connections shrunk expected, got", n)
+	}
+}
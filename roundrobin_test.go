@@ -107,3 +107,21 @@ func TestServiceRoundRobin(t *testing.T) {
 
 	t.Log("status:", s.Status())
 }
+
+func TestRoundRobinReset(t *testing.T) {
+	hosts := newScoredHosts(-1, -1, -1)
+	r := NewRoundRobin()
+
+	for _, a := range []string{"0", "1", "2", "0", "1"} {
+		if h := r.Select(hosts); h != hosts[a] {
+			t.Fatal(a, "expected")
+		}
+	}
+
+	r.Reset()
+	for _, a := range []string{"0", "1", "2"} {
+		if h := r.Select(hosts); h != hosts[a] {
+			t.Fatal(a, "expected after reset")
+		}
+	}
+}
@@ -1,10 +1,18 @@
 package pooly
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/cactus/go-statsd-client/statsd"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"reflect"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +37,29 @@ type ServiceConfig struct {
 	// Number of attempts to get a connection from the service before giving up (DefaultGetAttempts by default).
 	GetAttempts uint
 
+	// Return ErrNoHostAvailable right away instead of retrying when no host is registered (false by default).
+	// Retries still apply when hosts are registered but none could be selected.
+	FailFastNoHost bool
+
+	// Initial delay between two GetConn attempts, doubling at each attempt (none by default).
+	// Delays are randomly jittered so that concurrent callers don't retry in lockstep.
+	GetRetryBackoff time.Duration
+
+	// Maximum delay between two GetConn attempts when GetRetryBackoff is set (unlimited by default).
+	GetRetryMaxBackoff time.Duration
+
+	// Maximum time spent dialing a connection to a host at each GetConn attempt (unlimited by default).
+	// Hosts exceeding it (e.g. slow to resolve or handshake) are demoted and another one is tried instead.
+	// Waiting for a connection to be released when the pool of a host is saturated isn't accounted for.
+	DialBudget time.Duration
+
+	// Apply the deadline of the context given to GetConnContext (and its variants, e.g. GetConnContextExcluding) to the
+	// read and write deadlines of the connection returned, for the duration of the borrow (false by default).
+	// Timeouts bounding the acquisition only (e.g. GetConnTimeout) don't apply. Deadlines are cleared once the
+	// connection is released.
+	// It only applies to connections wrapping a net.Conn (see Conn.NetConn).
+	ApplyContextDeadline bool
+
 	// Deadline after which pools are forced closed (see Pool.ForceClose) (DefaultCloseDeadline by default).
 	CloseDeadline time.Duration
 
@@ -40,6 +71,19 @@ type ServiceConfig struct {
 	// Each score is calculated and cached for this duration (DefaultMemoizeScoreDuration by default).
 	MemoizeScoreDuration time.Duration
 
+	// Score assumed for time slots having no feedback recorded, within [0,1] (DefaultNeutralScore if nil).
+	// Lower values discourage unproven hosts while higher values encourage their exploration,
+	// zero treats them as down.
+	NeutralScore *float64
+
+	// Score given to hosts replying with a client error (4xx) through NewHTTPTransport, within [0,1]
+	// (DefaultHTTPClientErrorScore if nil). The request is likely at fault rather than the host.
+	HTTPClientErrorScore *float64
+
+	// Scores below this floor, within [0,1], are raised to it when reported to the BanditStrategy (0 by default).
+	// This keeps a host from being starved following a brief failure, its actual score still being learned.
+	HostScoreFloor float64
+
 	// Optional score calculator (none by default).
 	ScoreCalculator Computer
 
@@ -50,8 +94,60 @@ type ServiceConfig struct {
 	// Some strategies will favor fairness while others will prefer to pick hosts based on how well they perform.
 	BanditStrategy Selecter
 
+	// Optional hook called each time a host is selected for GetConn, with its address and score (none by default).
+	// The score is -1 if it hasn't been computed yet or if the BanditStrategy doesn't compute scores (e.g. RoundRobin).
+	// Selections include canary draws, probes and cached selections, but not gets from a given address (e.g. GetConnFrom).
+	// It is called outside of the service lock, from the goroutine calling GetConn, and must return quickly.
+	OnSelect func(addr string, score float64)
+
+	// Proactively reconnect hosts having lost all their connections (false by default).
+	// Hosts having no connection left and a score below FailureThreshold are reconnected
+	// with an exponential backoff starting from ReconnectBackoff (DefaultReconnectBackoff by default).
+	AutoReconnect    bool
+	ReconnectBackoff time.Duration
+
+	// Score below which a host is considered failed (DefaultFailureThreshold by default).
+	FailureThreshold float64
+
+	// Interval at which a host scored zero is handed a GetConn regardless of the BanditStrategy.
+	// This gives failed hosts a chance to recover when the strategy wouldn't explore them anymore.
+	// If the value is zero (default), then hosts are never probed. It has no effect if scores aren't computed (e.g. RoundRobin).
+	ProbeInterval time.Duration
+
+	// Address of a canary host, only handed out by GetConn for a fraction CanaryProbability of the calls
+	// (see GetConnProbabilistic). The BanditStrategy selects among the other hosts otherwise (none by default).
+	// If the canary is the only host registered, GetConn fails with ErrNoHostAvailable whenever it isn't drawn.
+	CanaryHost string
+
+	// Probability within [0,1] that GetConn returns a connection from CanaryHost (0 by default).
+	CanaryProbability float64
+
+	// Duration during which the host chosen by the BanditStrategy is reused by subsequent GetConn (disabled by default).
+	// Under heavy load, a short TTL (e.g. 1ms) saves a selection per call at the expense of balancing precision.
+	SelectionCacheTTL time.Duration
+
+	// Maximum number of hosts the service can hold, further additions are rejected (unlimited by default).
+	MaxHosts int
+
+	// Record the stack trace of every GetConn in order to find leaked connections (false by default).
+	// Connections checked out and not yet released are reported by InFlight.
+	TrackInFlight bool
+
+	// Optional store binding session keys to connections (none by default).
+	// It is required for GetConnWithStickinessKey to stick to connections.
+	SessionStore SessionStore
+
 	// Address and port of a statsd server to collect and aggregate pooly service metrics (none by default).
+	// Metrics are best effort, if the server can't be reached they are dropped until a connection is established.
 	StatsdAddr string
+
+	// Logger reporting noteworthy service events (standard logger by default).
+	Logger Logger
+}
+
+// Logger is the interface used by a service to log events, it is satisfied by the standard library log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
 }
 
 // Service manages several hosts, every one of them having a connection pool (see Pool).
@@ -60,23 +156,64 @@ type ServiceConfig struct {
 // The application calls the GetConn method to get a connection and releases it through the Conn.Release interface.
 // When one is done with the pool, Close will cleanup all the service resources.
 type Service struct {
+	// XXX counters must be 64-bit aligned for atomic operations, keep them first
+	getCount    uint64
+	getFails    uint64
+	getAttempts uint64
+	lastConnID  uint64 // shared by the hosts pools, connection IDs are unique within the service
+	waitTimeout int64
+	probedAt    int64
+	maxAttempts uint32
+	prespawn    uint32
+
 	*ServiceConfig
 
 	sync.RWMutex
-	name    string
-	hosts   map[string]*Host
-	decay   *time.Ticker
-	memoize *time.Ticker
-	add, rm chan string
-	stop    chan struct{}
-	stats   statsd.Statter
+	name     string
+	hosts    map[string]*Host
+	eligible map[string]*Host // hosts eligible to the BanditStrategy, all but the CanaryHost
+	decay    *time.Ticker
+	memoize  *time.Ticker
+	add      chan hostAddition
+	rm       chan string
+	rmAll    chan chan struct{}
+	stop     chan struct{}
+	stats    statsd.Statter
+	cached   atomic.Value
+	inflight *inFlightTracker
+	sessions sync.Map // hosts of the connections bound to session keys in the SessionStore, pruned along with the hosts
+}
+
+// Host selection cached for a given time (see SelectionCacheTTL).
+type selection struct {
+	host    *Host
+	expires time.Time
+}
+
+// ServiceMetrics is a snapshot of the service metrics, as reported to statsd.
+type ServiceMetrics struct {
+	// Number of connections successfully obtained through GetConn (and its variants).
+	GetConns uint64
+
+	// Number of times a host failed to provide a connection (see GetAttempts).
+	GetFails uint64
+
+	// Number of host selections performed, including retries.
+	GetAttempts uint64
+
+	// Number of hosts registered to the service.
+	Hosts int
+
+	// Number of connections spawned by the service.
+	Conns int64
+
+	// Number of times each host was selected by the BanditStrategy, keyed by address.
+	Selections map[string]uint64
 }
 
 // NewService creates a new service given a unique name.
 // If no configuration is specified (nil), defaults values are used.
 func NewService(name string, c *ServiceConfig) (*Service, error) {
-	var err error
-
 	if c == nil {
 		c = new(ServiceConfig)
 	}
@@ -98,24 +235,68 @@ func NewService(name string, c *ServiceConfig) (*Service, error) {
 	if c.BanditStrategy == nil {
 		c.BanditStrategy = NewRoundRobin()
 	}
+	if c.ReconnectBackoff == 0 {
+		c.ReconnectBackoff = DefaultReconnectBackoff
+	}
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = DefaultFailureThreshold
+	}
+	if c.NeutralScore == nil {
+		neutral := DefaultNeutralScore
+		c.NeutralScore = &neutral
+	}
+	if *c.NeutralScore < 0 || *c.NeutralScore > 1 {
+		return nil, ErrInvalidArg
+	}
+	if c.HTTPClientErrorScore == nil {
+		score := DefaultHTTPClientErrorScore
+		c.HTTPClientErrorScore = &score
+	}
+	if *c.HTTPClientErrorScore < 0 || *c.HTTPClientErrorScore > 1 {
+		return nil, ErrInvalidArg
+	}
+	if c.HostScoreFloor < 0 || c.HostScoreFloor > 1 {
+		return nil, ErrInvalidArg
+	}
+	if c.CanaryProbability < 0 || c.CanaryProbability > 1 {
+		return nil, ErrInvalidArg
+	}
+	if c.Logger == nil {
+		c.Logger = log.Default()
+	}
+	if c.ProbeInterval < 0 {
+		return nil, ErrInvalidArg
+	}
 
 	s := &Service{
 		ServiceConfig: c,
 		name:          name,
-		hosts:         make(map[string]*Host),
-		add:           make(chan string),
+		add:           make(chan hostAddition),
 		rm:            make(chan string),
+		rmAll:         make(chan chan struct{}),
 		stop:          make(chan struct{}),
+		waitTimeout:   int64(c.WaitTimeout),
+		maxAttempts:   uint32(c.GetAttempts),
+		prespawn:      uint32(c.PrespawnConns),
 	}
+	s.resetHosts()
+	if c.TrackInFlight {
+		s.inflight = newInFlightTracker()
+	}
+	s.decay = time.NewTicker(c.DecayDuration / seriesNum)
 	if _, ok := s.BanditStrategy.(*RoundRobin); !ok {
-		s.decay = time.NewTicker(c.DecayDuration / seriesNum)
 		s.memoize = time.NewTicker(c.MemoizeScoreDuration)
 	}
 	if c.StatsdAddr != "" {
-		s.stats, err = statsd.NewClient(c.StatsdAddr, "service."+name)
-		if err != nil {
-			return nil, err
+		// XXX metrics are best effort, keep retrying in background if the statsd server is unreachable
+		noop, _ := statsd.NewNoopClient()
+		st := newStatter(noop)
+		if client, err := newStatsdClient(c.StatsdAddr, "service."+name); err == nil {
+			st.set(client)
+		} else {
+			go s.dialStatsd(st)
 		}
+		s.stats = st
 	}
 	if s.stats == nil {
 		s.stats, _ = statsd.NewNoopClient()
@@ -126,10 +307,31 @@ func NewService(name string, c *ServiceConfig) (*Service, error) {
 		go s.monitor()
 	}
 
+	go s.score()
 	go s.serve()
 	return s, nil
 }
 
+// Connects to the statsd server, retrying until it succeeds or the service is closed.
+func (s *Service) dialStatsd(st *statter) {
+	t := time.NewTicker(statsdRetryDelay)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			client, err := newStatsdClient(s.StatsdAddr, "service."+s.name)
+			if err != nil {
+				continue
+			}
+			st.set(client)
+			s.Logger.Printf("pooly: service %s: connected to statsd server %s", s.name, s.StatsdAddr)
+			return
+		case <-s.stop:
+			return
+		}
+	}
+}
+
 func (s *Service) monitor() {
 	t := time.NewTicker(1 * time.Second)
 	for {
@@ -143,6 +345,13 @@ func (s *Service) monitor() {
 				n += int64(c)
 			}
 			s.stats.Gauge("conns.count", n, sampleRate)
+			s.stats.Gauge("conns.capacity_used_pct", int64(s.MaxCapacityUsedPercent()), sampleRate)
+			s.stats.Gauge("conns.waiters", int64(s.waiters()), sampleRate)
+			if s.Saturated() {
+				s.stats.Gauge("hosts.saturated", 1, sampleRate)
+			} else {
+				s.stats.Gauge("hosts.saturated", 0, sampleRate)
+			}
 
 		case <-s.stop:
 			t.Stop()
@@ -152,38 +361,51 @@ func (s *Service) monitor() {
 }
 
 func (s *Service) serve() {
-	var decay, memoize <-chan time.Time
-
-	if s.decay != nil {
-		decay = s.decay.C
-	}
-	if s.memoize != nil {
-		memoize = s.memoize.C
-	}
 	for {
 		select {
 		case a := <-s.add:
-			s.newHost(a)
+			err := s.newHost(a.address, a.tags)
+			if a.done != nil {
+				a.done <- err
+			}
 		case a := <-s.rm:
 			s.deleteHost(a)
-		case <-decay:
-			for _, h := range s.hosts {
-				h.decay()
-			}
-		case <-memoize:
-			// XXX lock to prevent selecting hosts during scores computation
-			//s.Lock()
-			for _, h := range s.hosts {
-				h.computeScore(s.ScoreCalculator)
+		case done := <-s.rmAll:
+			for a := range s.hosts {
+				s.deleteHost(a)
 			}
-			//c.Unlock()
+			close(done)
 		case <-s.stop:
 			for a := range s.hosts {
 				s.deleteHost(a)
 			}
-			if s.decay != nil {
-				s.decay.Stop()
+			return
+		}
+	}
+}
+
+// Decays and computes the hosts scores periodically, scores are only decayed if they aren't computed (e.g. RoundRobin).
+// It runs apart from serve so that hosts changes are processed promptly regardless of the fleet size.
+func (s *Service) score() {
+	var memoize <-chan time.Time
+
+	if s.memoize != nil {
+		memoize = s.memoize.C
+	}
+	for {
+		select {
+		case <-s.decay.C:
+			// XXX ticks are dropped when we fall behind, rely on the actual time elapsed instead
+			now := time.Now()
+			for _, h := range s.snapshot() {
+				h.decayAt(now, s.DecayDuration/seriesNum)
+			}
+		case <-memoize:
+			for _, h := range s.snapshot() {
+				h.computeScore(s.ScoreCalculator)
 			}
+		case <-s.stop:
+			s.decay.Stop()
 			if s.memoize != nil {
 				s.memoize.Stop()
 			}
@@ -192,35 +414,137 @@ func (s *Service) serve() {
 	}
 }
 
-func (s *Service) newHost(a string) {
+// Returns the hosts currently registered to the service.
+func (s *Service) snapshot() []*Host {
+	s.RLock()
+	hosts := make([]*Host, 0, len(s.hosts))
+	for _, h := range s.hosts {
+		hosts = append(hosts, h)
+	}
+	s.RUnlock()
+	return hosts
+}
+
+// Maximum reconnection backoff, as a factor of ServiceConfig.ReconnectBackoff.
+const maxReconnectBackoff = 64
+
+// Reported to host addition requests when the host is already registered.
+var errHostExists = errors.New("pooly: host already exists")
+
+// Host addition request, done (if any) receives the outcome of the operation.
+type hostAddition struct {
+	address string
+	done    chan error
+	tags    map[string]string
+}
+
+func (s *Service) newHost(a string, tags map[string]string) error {
 	s.Lock()
 	if h := s.hosts[a]; h != nil {
+		if tags != nil {
+			h.tags = tags
+		}
 		s.Unlock()
-		return
+		return errHostExists
+	}
+	if s.MaxHosts > 0 && len(s.hosts) >= s.MaxHosts {
+		s.Unlock()
+		return ErrMaxHostsReached
 	}
 
 	p := NewPool(a, &s.PoolConfig)
+	p.setIDs(&s.lastConnID)
 	p.setStats(s.stats)
+	p.SetWaitTimeout(time.Duration(atomic.LoadInt64(&s.waitTimeout)))
 
-	p.New(s.PrespawnConns)
-	s.hosts[a] = &Host{
+	p.New(s.prespawnConns())
+	h := &Host{
 		pool:       p,
 		timeSeries: make([]serie, 1, seriesNum),
 		score:      -1,
+		decayedAt:  time.Now(),
+		memoized:   s.memoize != nil,
+		neutral:    *s.NeutralScore,
+		floor:      s.HostScoreFloor,
 		stats:      s.stats,
+		quit:       make(chan struct{}),
+		inflight:   s.inflight,
+		tags:       tags,
 	}
+	s.setHost(a, h)
 	s.Unlock()
+
+	if s.AutoReconnect {
+		go s.reconnect(h)
+	}
+	return nil
+}
+
+// Reconnects a given host whenever it fails, backing off exponentially until connections are established.
+func (s *Service) reconnect(h *Host) {
+	backoff := s.ReconnectBackoff
+	for {
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-h.quit:
+			t.Stop()
+			return
+		}
+
+		if h.pool.establishedConns() > 0 {
+			backoff = s.ReconnectBackoff // host is up
+			continue
+		}
+		failed := !h.memoized || h.Score() < s.FailureThreshold
+		if h.pool.ActiveConns() == 0 && failed {
+			h.pool.New(s.prespawnConns())
+			if backoff < maxReconnectBackoff*s.ReconnectBackoff {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// Resets the hosts registered to the service, the lock must be held.
+func (s *Service) resetHosts() {
+	s.hosts = make(map[string]*Host)
+	s.eligible = s.hosts
+	if s.CanaryHost != "" {
+		s.eligible = make(map[string]*Host)
+	}
+}
+
+// Registers a host at a given address, the lock must be held.
+func (s *Service) setHost(a string, h *Host) {
+	s.hosts[a] = h
+	if a != s.CanaryHost {
+		s.eligible[a] = h
+	}
+}
+
+// Unregisters the host at a given address, the lock must be held.
+func (s *Service) unsetHost(a string) {
+	delete(s.hosts, a)
+	delete(s.eligible, a)
 }
 
 func (s *Service) deleteHost(a string) {
 	s.Lock()
 	h := s.hosts[a]
-	delete(s.hosts, a)
+	s.unsetHost(a)
 	s.Unlock()
 
 	if h == nil {
 		return
 	}
+	s.unbindSessions(h)
+	s.drain(h)
+}
+
+// Closes the pool of a removed host in background, forcefully after CloseDeadline.
+func (s *Service) drain(h *Host) {
+	close(h.quit)
 	go func() {
 		time.AfterFunc(s.CloseDeadline, func() {
 			h.pool.ForceClose()
@@ -237,7 +561,81 @@ func (s *Service) Name() string {
 // Add adds a given host to the service.
 // The effect of such operation may not be reflected immediately.
 func (s *Service) Add(address string) {
-	s.add <- address
+	s.add <- hostAddition{address: address}
+}
+
+// AddSync is like Add but waits for the host to be added.
+// It returns true if the host was already registered, in which case it is left unchanged.
+// It returns ErrMaxHostsReached if the service can't hold any more host (see ServiceConfig.MaxHosts).
+func (s *Service) AddSync(address string) (existed bool, err error) {
+	done := make(chan error, 1)
+	s.add <- hostAddition{address: address, done: done}
+	if err = <-done; err == errHostExists {
+		return true, nil
+	}
+	return false, err
+}
+
+func (s *Service) getAttemptsMax() uint {
+	return uint(atomic.LoadUint32(&s.maxAttempts))
+}
+
+func (s *Service) prespawnConns() uint {
+	return uint(atomic.LoadUint32(&s.prespawn))
+}
+
+// SetGetAttempts changes the number of attempts subsequent GetConn operations make before giving up.
+// Note that the GetAttempts of the service configuration remains unchanged.
+func (s *Service) SetGetAttempts(n uint) error {
+	if n == 0 || n > math.MaxUint32 {
+		return ErrInvalidArg
+	}
+	atomic.StoreUint32(&s.maxAttempts, uint32(n))
+	return nil
+}
+
+// SetPrespawnConns changes the number of connections prespawned on subsequent hosts additions and reconnections.
+// Zero disables prespawning, connections are then only dialed on demand.
+// It returns ErrInvalidArg if n exceeds MaxConns.
+// Note that the PrespawnConns of the service configuration remains unchanged.
+func (s *Service) SetPrespawnConns(n uint) error {
+	s.RLock() // defaults are filled by NewPool under the lock
+	max := s.MaxConns
+	s.RUnlock()
+	if max <= 0 {
+		max = DefaultMaxConns // no host added yet
+	}
+	if n > uint(max) {
+		return ErrInvalidArg
+	}
+	atomic.StoreUint32(&s.prespawn, uint32(n))
+	return nil
+}
+
+// SetWaitTimeout changes the duration during which subsequent GetConn operations wait for a connection
+// from the pool of a host (see Pool.SetWaitTimeout). Zero means waiting forever.
+// Note that the WaitTimeout of the service configuration remains unchanged.
+func (s *Service) SetWaitTimeout(d time.Duration) error {
+	if d < 0 {
+		return ErrInvalidArg
+	}
+	s.Lock()
+	atomic.StoreInt64(&s.waitTimeout, int64(d))
+	for _, h := range s.hosts {
+		h.pool.SetWaitTimeout(d)
+	}
+	s.Unlock()
+	return nil
+}
+
+// AddTagged is like Add but also tags the host with a set of key/value pairs (e.g. datacenter, version or role).
+// If the host is already registered, its tags are replaced. Hosts can then be selected by tags (see GetConnMatching).
+func (s *Service) AddTagged(address string, tags map[string]string) {
+	m := make(map[string]string, len(tags))
+	for k, v := range tags {
+		m[k] = v
+	}
+	s.add <- hostAddition{address: address, tags: m}
 }
 
 // Remove removes a given host from the service.
@@ -246,62 +644,1255 @@ func (s *Service) Remove(address string) {
 	s.rm <- address
 }
 
+// RemoveAll removes all the hosts from the service at once, their pools are closed in the background as with Remove.
+// Unlike Close, the service remains usable and new hosts can be added afterwards.
+// It returns ErrPoolClosed if the service has been closed.
+func (s *Service) RemoveAll() error {
+	done := make(chan struct{})
+	select {
+	case <-s.stop:
+		return ErrPoolClosed
+	default:
+	}
+	select {
+	case s.rmAll <- done:
+	case <-s.stop:
+		return ErrPoolClosed
+	}
+	<-done
+	return nil
+}
+
 // GetConn returns a connection from the service.
 // The host serving the connection is chosen according to the BanditStrategy policy in place.
 func (s *Service) GetConn() (*Conn, error) {
-	var attempts uint
+	return s.GetConnContext(context.Background())
+}
 
-	start := time.Now()
-again:
-	s.RLock()
-	if len(s.hosts) == 0 {
-		s.RUnlock()
-		if attempts < s.GetAttempts {
-			attempts++
-			goto again
-		}
-		return nil, ErrNoHostAvailable
+// GetConnTimeout is like GetConn but gives up after the given timeout.
+func (s *Service) GetConnTimeout(timeout time.Duration) (*Conn, error) {
+	if timeout <= 0 {
+		return nil, ErrInvalidArg
 	}
-	h := s.BanditStrategy.Select(s.hosts)
-	s.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.getConn(ctx, getOptions{})
+}
+
+// GetConnContext is like GetConn but gives up when the given context is done.
+// In such case, it returns the context error.
+// If ApplyContextDeadline is set, the context deadline governs the I/O on the connection returned.
+func (s *Service) GetConnContext(ctx context.Context) (*Conn, error) {
+	return s.getConnContext(ctx, getOptions{})
+}
 
-	c, err := h.pool.Get()
+// Gets a connection within a context given by the caller, applying its deadline to the connection if
+// ApplyContextDeadline is set.
+func (s *Service) getConnContext(ctx context.Context, opts getOptions) (*Conn, error) {
+	c, err := s.getConn(ctx, opts)
 	if err != nil {
-		// Pool is closed or timed out, demote the host and start over
-		s.stats.Inc("conns.get.fails", 1, sampleRate)
-		h.rate(HostDown)
-		if attempts < s.GetAttempts {
-			attempts++
-			goto again
-		}
-		return nil, fmt.Errorf("%s: %v", s.name, err)
+		return nil, err
 	}
+	s.applyDeadline(ctx, c)
+	return c, nil
+}
 
-	// Send statsd metrics
-	end := time.Now()
-	dt := int64(end.Sub(start).Seconds() * 1000)
-	s.stats.Timing("conns.get.delay", dt, sampleRate)
-	s.stats.Inc("conns.get.count", 1, sampleRate)
-	if _, ok := s.BanditStrategy.(*RoundRobin); !ok {
-		p := int64(h.Score() * 100)
-		s.stats.Timing("hosts.score", p, sampleRate)
+// Applies the context deadline to the connection if ApplyContextDeadline is set.
+func (s *Service) applyDeadline(ctx context.Context, c *Conn) {
+	if !s.ApplyContextDeadline {
+		return
 	}
+	if d, ok := ctx.Deadline(); ok && c.SetDeadline(d) == nil {
+		c.deadline = true
+	}
+}
 
-	c.setTime(end)
-	c.setHost(h)
-	return c, nil
+// Context done when a cancel channel is closed.
+type cancelContext struct {
+	context.Context
+	cancel <-chan struct{}
 }
 
-// Status returns every host addresses managed by the service along with
-// the number of connections handled by their respective pool thus far.
-func (s *Service) Status() map[string]int32 {
+func (c cancelContext) Done() <-chan struct{} {
+	return c.cancel
+}
+
+func (c cancelContext) Err() error {
+	select {
+	case <-c.cancel:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
+
+// GetConnCancel is like GetConn but gives up when the given channel is closed.
+// In such case, it returns ErrCanceled.
+func (s *Service) GetConnCancel(cancel <-chan struct{}) (*Conn, error) {
+	c, err := s.getConn(cancelContext{context.Background(), cancel}, getOptions{})
+	if err == context.Canceled {
+		err = ErrCanceled
+	}
+	return c, err
+}
+
+// DebugInfo describes how a connection was obtained from the service (see GetConnDebug).
+type DebugInfo struct {
+	// Address of the host selected.
+	SelectedHost string
+
+	// Number of attempts needed to get the connection.
+	AttemptCount uint
+
+	// Name of the bandit strategy in place.
+	StrategyName string
+
+	// Scores of the eligible hosts at selection time (see Host.Score), -1 for the hosts unscored.
+	// Every eligible host is reported, even if the bandit strategy doesn't use scores (e.g. RoundRobin).
+	HostScores map[string]float64
+
+	// Time taken by the bandit strategy to select the host.
+	SelectionLatency time.Duration
+}
+
+// GetConnDebug is like GetConn but also reports how the connection was obtained.
+func (s *Service) GetConnDebug() (*Conn, DebugInfo, error) {
+	var d DebugInfo
+
+	d.StrategyName = reflect.Indirect(reflect.ValueOf(s.BanditStrategy)).Type().Name()
+	c, err := s.getConn(context.Background(), getOptions{debug: &d})
+	return c, d, err
+}
+
+// GetConnPreferred is like GetConnFrom but falls back to the BanditStrategy among the other hosts if the given host
+// is not registered or fails to provide a connection (e.g. for cache affinity, where a miss should still succeed elsewhere).
+func (s *Service) GetConnPreferred(address string) (*Conn, error) {
+	return s.getConnPreferred(context.Background(), context.Background(), address)
+}
+
+// Gets a connection from a given host, giving up on it once pctx is done, and falls back to the other hosts within ctx.
+func (s *Service) getConnPreferred(ctx, pctx context.Context, address string) (*Conn, error) {
+	c, err := s.getConn(pctx, getOptions{address: address, retry: &RetryPolicy{MaxAttempts: 1}})
+	if err == nil {
+		return c, nil
+	}
+	return s.getConn(ctx, getOptions{filter: func(h *Host) bool { return h.Address() != address }})
+}
+
+// GetConnWithTimeout is like GetConnTimeout but tries to get the connection from preferHost first (if not empty).
+// Half of the timeout is spent on preferHost, after which it falls back to the other hosts like GetConnPreferred
+// for the remaining time. It returns ErrHostNotFound if preferHost is not registered to the service.
+func (s *Service) GetConnWithTimeout(timeout time.Duration, preferHost string) (*Conn, error) {
+	if timeout <= 0 {
+		return nil, ErrInvalidArg
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if preferHost == "" {
+		return s.getConn(ctx, getOptions{})
+	}
+
 	s.RLock()
-	m := make(map[string]int32, len(s.hosts))
-	for a, h := range s.hosts {
-		m[a] = h.pool.ActiveConns()
+	_, ok := s.hosts[preferHost]
+	s.RUnlock()
+	if !ok {
+		return nil, ErrHostNotFound
+	}
+
+	pctx, pcancel := context.WithTimeout(ctx, timeout/2)
+	defer pcancel()
+	return s.getConnPreferred(ctx, pctx, preferHost)
+}
+
+// GetConnWithFilter is like GetConn but the BanditStrategy only selects among the hosts for which fn returns true
+// (e.g. hosts serving a given tenant, see Host.Address). fn is called with the service read lock held and must not
+// modify the service. It returns ErrNoHostAvailable if no host satisfies the filter.
+func (s *Service) GetConnWithFilter(fn func(*Host) bool) (*Conn, error) {
+	if fn == nil {
+		return nil, ErrInvalidArg
+	}
+	return s.getConn(context.Background(), getOptions{filter: fn})
+}
+
+// GetConnMatching is like GetConn but the BanditStrategy only selects among the hosts tagged with all the given tags
+// (see AddTagged). It returns ErrNoHostAvailable if no host matches.
+func (s *Service) GetConnMatching(tags map[string]string) (*Conn, error) {
+	return s.GetConnWithFilter(func(h *Host) bool {
+		for k, v := range tags {
+			if t, ok := h.tags[k]; !ok || t != v {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// RetryPolicy defines how GetConn operations retry on failure (see GetConnRetryPolicy).
+type RetryPolicy struct {
+	// Maximum number of attempts, the first one included (a single attempt if zero).
+	MaxAttempts uint
+
+	// Delay before the first retry (none by default).
+	Backoff time.Duration
+
+	// Factor by which the delay grows at each retry (constant delay if less than 1).
+	BackoffFactor float64
+
+	// Tells whether a failed attempt should be retried given its error (any error is retried if nil).
+	// The error is ErrNoHostAvailable if no host could be selected.
+	ShouldRetry func(err error) bool
+}
+
+// Returns the delay before a given retry attempt.
+func (p *RetryPolicy) delay(attempt uint) time.Duration {
+	d := float64(p.Backoff)
+	if p.BackoffFactor > 1 {
+		d *= math.Pow(p.BackoffFactor, float64(attempt-1))
+	}
+	if d > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// GetConnRetryPolicy is like GetConn but retries according to the given policy instead of
+// GetAttempts and GetRetryBackoff.
+func (s *Service) GetConnRetryPolicy(policy RetryPolicy) (*Conn, error) {
+	return s.GetConnContextRetryPolicy(context.Background(), policy)
+}
+
+// GetConnContextRetryPolicy is like GetConnRetryPolicy but gives up when the given context is done.
+// In such case, it returns the context error.
+// If ApplyContextDeadline is set, the context deadline governs the I/O on the connection returned.
+func (s *Service) GetConnContextRetryPolicy(ctx context.Context, policy RetryPolicy) (*Conn, error) {
+	return s.getConnContext(ctx, getOptions{retry: &policy})
+}
+
+// GetConnProbabilistic is like GetConn but returns a connection from the CanaryHost with probability p within [0,1],
+// overriding CanaryProbability (e.g. for A/B testing or canary rollouts).
+// It returns ErrHostNotFound if the canary host is not registered to the service.
+func (s *Service) GetConnProbabilistic(p float64) (*Conn, error) {
+	if p < 0 || p > 1 {
+		return nil, ErrInvalidArg
 	}
+	s.RLock()
+	h := s.hosts[s.CanaryHost]
 	s.RUnlock()
-	return m
+	if h == nil {
+		return nil, ErrHostNotFound
+	}
+	return s.getConn(context.Background(), getOptions{canary: &p})
+}
+
+// GetConnExcluding is like GetConn but the BanditStrategy never selects the given hosts
+// (e.g. read replicas for operations requiring a primary). It returns ErrNoHostAvailable if all hosts are excluded.
+func (s *Service) GetConnExcluding(excluded ...string) (*Conn, error) {
+	return s.GetConnContextExcluding(context.Background(), excluded...)
+}
+
+// GetConnContextExcluding is like GetConnExcluding but gives up when the given context is done.
+// In such case, it returns the context error.
+// If ApplyContextDeadline is set, the context deadline governs the I/O on the connection returned.
+func (s *Service) GetConnContextExcluding(ctx context.Context, excluded ...string) (*Conn, error) {
+	set := make(map[string]bool, len(excluded))
+	for _, a := range excluded {
+		set[a] = true
+	}
+	return s.getConnContext(ctx, getOptions{filter: func(h *Host) bool { return !set[h.Address()] }})
+}
+
+// GetConnFrom is like GetConn but gets the connection from a given host, bypassing the BanditStrategy.
+// It returns ErrHostNotFound if the host is not registered to the service.
+// Releasing the connection scores the host as usual.
+func (s *Service) GetConnFrom(address string) (*Conn, error) {
+	return s.getConn(context.Background(), getOptions{address: address})
+}
+
+// GetConnLeastScore is like GetConn but gets the connection from the host having the lowest score, bypassing the BanditStrategy.
+// It is meant for debugging and testing purposes (e.g. stressing the weakest host).
+// Hosts whose score has been invalidated come first, ties are broken by address.
+// If no score has been computed yet or the BanditStrategy doesn't use scores (e.g. RoundRobin), it is equivalent to GetConn.
+func (s *Service) GetConnLeastScore() (*Conn, error) {
+	var address string
+	var scored bool
+
+	if s.memoize == nil {
+		return s.GetConn()
+	}
+
+	s.RLock()
+	least := math.Inf(1)
+	for a, h := range s.hosts {
+		score := h.Score()
+		if score >= 0 {
+			scored = true
+		}
+		if score < least || (score == least && a < address) {
+			least, address = score, a
+		}
+	}
+	s.RUnlock()
+
+	if !scored {
+		return s.GetConn()
+	}
+	return s.getConn(context.Background(), getOptions{address: address})
+}
+
+// GetConnWithStickinessKey is like GetConn but sticks to the connection previously bound to a given key in the SessionStore.
+// The bound connection is only retrieved if it is idle (i.e. it has been released), otherwise GetConn is used instead
+// and the key is bound to the new connection. Keys bound to the connections of a removed host are deleted from the store,
+// while the ones bound to the connections of a rebound host are bound to a new connection of the host (see Rebind).
+// Without SessionStore, it is equivalent to GetConn.
+func (s *Service) GetConnWithStickinessKey(key string) (*Conn, error) {
+	if s.SessionStore == nil {
+		return s.GetConn()
+	}
+
+	if v, ok := s.sessions.Load(key); ok {
+		if h := v.(*Host); !h.removed() {
+			if id, ok := s.SessionStore.Get(key); ok {
+				if c := h.pool.getByID(id); c != nil {
+					s.stats.Inc("conns.get.count", 1, sampleRate)
+					atomic.AddUint64(&s.getCount, 1)
+					c.setTime(time.Now())
+					c.setHost(h)
+					s.inflight.add(c)
+					return c, nil
+				}
+			} else if c, err := s.getConn(context.Background(), getOptions{address: h.Address()}); err == nil {
+				// Key bound to the host itself (see Rebind), bind it to one of its connections
+				s.SessionStore.Set(key, c.ID())
+				return c, nil
+			}
+		}
+		s.SessionStore.Delete(key)
+		s.sessions.Delete(key)
+	} else if _, ok := s.SessionStore.Get(key); ok {
+		s.SessionStore.Delete(key)
+	}
+
+	c, err := s.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	s.SessionStore.Set(key, c.ID())
+	s.sessions.Store(key, c.host)
+	return c, nil
+}
+
+// Binds the session keys bound to the connections of a given host to the host itself, its connections being renewed.
+func (s *Service) rebindSessions(h *Host) {
+	if s.SessionStore == nil {
+		return
+	}
+
+	s.sessions.Range(func(k, v interface{}) bool {
+		if v.(*Host) == h {
+			s.SessionStore.Delete(k.(string))
+		}
+		return true
+	})
+}
+
+// Deletes the session keys bound to the connections of a given host.
+func (s *Service) unbindSessions(h *Host) {
+	if s.SessionStore == nil {
+		return
+	}
+	s.sessions.Range(func(k, v interface{}) bool {
+		if v.(*Host) == h {
+			s.sessions.Delete(k)
+			s.SessionStore.Delete(k.(string))
+		}
+		return true
+	})
+}
+
+// Options of a single getConn operation.
+type getOptions struct {
+	// Address of the host to get the connection from, bypassing the BanditStrategy (none if empty).
+	address string
+
+	// Hosts eligible for selection (all of them if nil).
+	filter func(*Host) bool
+
+	// Debugging information to fill, if any.
+	debug *DebugInfo
+
+	// Retry policy overriding GetAttempts and GetRetryBackoff, if any.
+	retry *RetryPolicy
+
+	// Probability overriding CanaryProbability, if any.
+	canary *float64
+
+	// Host already selected for the first attempt, retries select again (none if nil).
+	selected *Host
+
+	// Accounting left to the caller once the connection is known to be kept (see GetConnHedged), if any.
+	record *getRecord
+}
+
+// Accounting of a getConn operation, deferred until its connection is kept (see getOptions.record).
+type getRecord struct {
+	attempts uint64
+	selected []*Host
+	start    time.Time
+}
+
+// Returns the cached host selection, if any and still valid.
+func (s *Service) cachedHost() *Host {
+	c, ok := s.cached.Load().(selection)
+	if !ok || c.host == nil || time.Now().After(c.expires) || c.host.removed() {
+		return nil
+	}
+	return c.host
+}
+
+// Drops the cached host selection.
+func (s *Service) uncache() {
+	if s.SelectionCacheTTL > 0 {
+		s.cached.Store(selection{})
+	}
+}
+
+// Selects a host among the eligible ones, it returns nil if there is none.
+func (s *Service) selectHost(opts *getOptions) (h *Host) {
+	h = s.pickHost(opts)
+	if s.OnSelect != nil && h != nil && opts.address == "" {
+		s.OnSelect(h.Address(), h.reportedScore())
+	}
+	return
+}
+
+func (s *Service) pickHost(opts *getOptions) (h *Host) {
+	if opts.address != "" {
+		s.RLock()
+		h = s.hosts[opts.address]
+		s.RUnlock()
+		return
+	}
+
+	if canary := s.CanaryHost; canary != "" && opts.filter == nil && opts.debug == nil {
+		p := s.CanaryProbability
+		if opts.canary != nil {
+			p = *opts.canary
+		}
+		if p > 0 && rand.Float64() < p {
+			s.RLock()
+			h = s.hosts[canary]
+			s.RUnlock()
+			if h != nil {
+				return
+			}
+		}
+	}
+
+	if opts.filter == nil && opts.debug == nil {
+		if h = s.probe(); h != nil {
+			return
+		}
+	}
+
+	cacheable := s.SelectionCacheTTL > 0 && opts.filter == nil && opts.debug == nil
+	if cacheable {
+		if h = s.cachedHost(); h != nil {
+			return
+		}
+	}
+
+	s.RLock()
+	hosts := s.eligible
+	if opts.filter != nil {
+		hosts = make(map[string]*Host, len(s.eligible))
+		for a, h := range s.eligible {
+			if opts.filter(h) {
+				hosts[a] = h
+			}
+		}
+	}
+	if d := opts.debug; d != nil {
+		d.HostScores = make(map[string]float64, len(hosts))
+		for a, h := range hosts {
+			d.HostScores[a] = h.reportedScore()
+		}
+	}
+	if len(hosts) > 0 {
+		start := time.Now()
+		h = s.BanditStrategy.Select(hosts)
+		if opts.debug != nil {
+			opts.debug.SelectionLatency = time.Since(start)
+		}
+	}
+	s.RUnlock()
+
+	if cacheable && h != nil {
+		s.cached.Store(selection{host: h, expires: time.Now().Add(s.SelectionCacheTTL)})
+	}
+	return
+}
+
+// Returns a host scored zero once every ProbeInterval, nil otherwise.
+func (s *Service) probe() (h *Host) {
+	if s.ProbeInterval == 0 || s.memoize == nil {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.probedAt)
+	if now-last < int64(s.ProbeInterval) || !atomic.CompareAndSwapInt64(&s.probedAt, last, now) {
+		return nil
+	}
+
+	s.RLock()
+	for _, c := range s.eligible {
+		c.RLock()
+		zero := c.score == 0 // actual score, regardless of HostScoreFloor
+		c.RUnlock()
+		if zero {
+			h = c
+			break
+		}
+	}
+	s.RUnlock()
+	return
+}
+
+// Returns the delay before a given retry attempt, it grows exponentially up to GetRetryMaxBackoff.
+// Delays are jittered in [d/2,d] so that concurrent callers don't retry in lockstep.
+func (s *Service) retryBackoff(attempt uint) time.Duration {
+	if s.GetRetryBackoff <= 0 || attempt == 0 {
+		return 0
+	}
+
+	d := s.GetRetryMaxBackoff
+	if attempt <= 32 {
+		if e := s.GetRetryBackoff << (attempt - 1); e > 0 && (d <= 0 || e < d) {
+			d = e
+		}
+	}
+	if d <= 0 {
+		d = s.GetRetryBackoff // overflow without cap
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Waits before a given retry attempt, unless the context is done.
+func (s *Service) backoff(ctx context.Context, attempt uint) {
+	d := s.retryBackoff(attempt)
+	if d == 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		t.Stop()
+	}
+}
+
+// Gets a connection from a given host within the DialBudget.
+func (s *Service) getFromHost(ctx context.Context, h *Host) (*Conn, error) {
+	return h.pool.getContext(ctx, s.DialBudget)
+}
+
+// Decides whether to retry after a given failed attempt, waiting beforehand as needed.
+// The number of attempts is incremented if so.
+func (s *Service) retry(ctx context.Context, opts *getOptions, attempts *uint, err error) bool {
+	p := opts.retry
+	if p == nil {
+		if *attempts >= s.getAttemptsMax() {
+			return false
+		}
+		*attempts++
+		s.backoff(ctx, *attempts)
+		return true
+	}
+
+	if *attempts+1 >= p.MaxAttempts || (p.ShouldRetry != nil && !p.ShouldRetry(err)) {
+		return false
+	}
+	*attempts++
+	if d := p.delay(*attempts); d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+	return true
+}
+
+// Accounts for an attempt to get a connection, along with the host selected if any.
+func (s *Service) countAttempt(h *Host, selected bool) {
+	atomic.AddUint64(&s.getAttempts, 1)
+	if h != nil && selected {
+		atomic.AddUint64(&h.selections, 1)
+		s.stats.Inc("hosts.selected."+statsdKey(h.pool.Address()), 1, sampleRate)
+	}
+}
+
+// Accounts for a connection obtained from a given host.
+func (s *Service) countGet(h *Host, start, end time.Time) {
+	// Send statsd metrics
+	dt := int64(end.Sub(start).Seconds() * 1000)
+	s.stats.Timing("conns.get.delay", dt, sampleRate)
+	s.stats.Inc("conns.get.count", 1, sampleRate)
+	atomic.AddUint64(&s.getCount, 1)
+	if _, ok := s.BanditStrategy.(*RoundRobin); !ok {
+		p := int64(h.Score() * 100)
+		s.stats.Timing("hosts.score", p, sampleRate)
+	}
+}
+
+// Accounts for a getConn operation whose accounting was deferred (see getOptions.record).
+// c is the connection kept, nil if the operation failed.
+func (s *Service) commit(r *getRecord, c *Conn) {
+	atomic.AddUint64(&s.getAttempts, r.attempts-uint64(len(r.selected)))
+	for _, h := range r.selected {
+		s.countAttempt(h, true)
+	}
+	if c != nil {
+		s.countGet(c.host, r.start, c.gottenAt)
+	}
+}
+
+func (s *Service) getConn(ctx context.Context, opts getOptions) (*Conn, error) {
+	var attempts uint
+
+	start := time.Now()
+again:
+	if opts.debug != nil {
+		opts.debug.AttemptCount = attempts + 1
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	h := opts.selected
+	if h != nil {
+		opts.selected = nil
+	} else {
+		h = s.selectHost(&opts)
+	}
+	if r := opts.record; r != nil {
+		r.attempts++
+		if h != nil && opts.address == "" {
+			r.selected = append(r.selected, h)
+		}
+	} else {
+		s.countAttempt(h, opts.address == "")
+	}
+	if h == nil {
+		if opts.address != "" {
+			return nil, ErrHostNotFound // retrying won't register it
+		}
+		if s.FailFastNoHost && s.Len() == 0 {
+			return nil, ErrNoHostAvailable
+		}
+		if s.retry(ctx, &opts, &attempts, ErrNoHostAvailable) {
+			goto again
+		}
+		return nil, ErrNoHostAvailable
+	}
+
+	c, err := s.getFromHost(ctx, h)
+	if n := h.pool.takeBorrowFails(); n > 0 {
+		h.rateN(HostDown, n) // connections failing validation are held against the host
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, err // given up by the caller, don't hold it against the host
+	}
+	if err != nil {
+		// Pool is closed or timed out, demote the host and start over
+		s.stats.Inc("conns.get.fails", 1, sampleRate)
+		atomic.AddUint64(&s.getFails, 1)
+		s.uncache()
+		h.rate(HostDown)
+		h.invalidate()
+		if s.retry(ctx, &opts, &attempts, err) {
+			goto again
+		}
+		return nil, fmt.Errorf("%s: %v", s.name, err)
+	}
+
+	end := time.Now()
+	if r := opts.record; r != nil {
+		r.start = start
+	} else {
+		s.countGet(h, start, end)
+	}
+
+	if opts.debug != nil {
+		opts.debug.SelectedHost = h.pool.Address()
+	}
+	c.setTime(end)
+	c.setHost(h)
+	s.inflight.add(c)
+	return c, nil
+}
+
+// GetConnHedged is like GetConn but if no connection could be obtained from the selected host within hedgeAfter,
+// it concurrently tries another host and returns whichever connection comes first.
+// This cuts tail latencies when a host is momentarily slow to serve. Only the connection returned is accounted for
+// in the service metrics, the unused one, if any, is released with a NeutralScore feedback.
+func (s *Service) GetConnHedged(hedgeAfter time.Duration) (*Conn, error) {
+	type result struct {
+		conn   *Conn
+		err    error
+		record *getRecord
+	}
+
+	h := s.selectHost(&getOptions{})
+	if h == nil {
+		return nil, ErrNoHostAvailable
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan result, 2)
+	acquire := func(opts getOptions) {
+		opts.record = new(getRecord)
+		c, err := s.getConn(ctx, opts)
+		results <- result{c, err, opts.record}
+	}
+
+	go acquire(getOptions{selected: h, filter: func(x *Host) bool { return x == h }})
+	hedge := time.NewTimer(hedgeAfter)
+	defer hedge.Stop()
+
+	var failed []*getRecord
+	pending, hedged := 1, false
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				s.commit(r.record, r.conn)
+				go func(n int) {
+					// Release the connections obtained by the losers
+					for i := 0; i < n; i++ {
+						if r := <-results; r.err == nil {
+							r.conn.Release(nil, *s.NeutralScore)
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			failed = append(failed, r.record)
+			if pending == 0 && hedged {
+				for _, f := range failed {
+					s.commit(f, nil) // every attempt failed, account for all of them
+				}
+				return nil, r.err
+			}
+			if !hedged {
+				hedge.Reset(0) // hedge right away
+			}
+		case <-hedge.C:
+			if !hedged {
+				hedged = true
+				pending++
+				go acquire(getOptions{filter: func(x *Host) bool { return x != h }})
+			}
+		}
+	}
+}
+
+// DialBest is like GetConn but returns the underlying net.Conn (see Conn.NetConn) directly.
+// Closing it releases the connection back to the service, scoring the host according to the I/O errors encountered.
+// It returns ErrNotNetConn if the underlying user object is not a net.Conn, the connection being released.
+func (s *Service) DialBest() (net.Conn, error) {
+	c, err := s.GetConn()
+	if err != nil {
+		return nil, err
+	}
+	nc := c.NetConn()
+	if nc == nil {
+		c.Release(nil, *s.NeutralScore) // misconfiguration, not the host fault
+		return nil, ErrNotNetConn
+	}
+
+	w := &releaseWrapper{
+		Conn: nc,
+		conn: c,
+	}
+	return w, nil
+}
+
+// GetConnAll gets one connection from every host of the service concurrently, bypassing the BanditStrategy
+// (e.g. to replicate writes, see MultiConn). If any of them can't be obtained, the others are released with a
+// NeutralScore feedback and ErrPartialAcquisition is returned, wrapping the individual errors.
+// It returns ErrNoHostAvailable if the service has no host.
+func (s *Service) GetConnAll() ([]*Conn, error) {
+	var w sync.WaitGroup
+
+	hosts := s.snapshot()
+	if len(hosts) == 0 {
+		return nil, ErrNoHostAvailable
+	}
+	conns := make([]*Conn, len(hosts))
+	errs := make([]error, len(hosts))
+	w.Add(len(hosts))
+	for i, h := range hosts {
+		go func(i int, a string) {
+			conns[i], errs[i] = s.GetConnFrom(a)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%s: %w", a, errs[i])
+			}
+			w.Done()
+		}(i, h.pool.Address())
+	}
+	w.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		for _, c := range conns {
+			if c != nil {
+				c.Release(nil, *s.NeutralScore) // unused, no feedback on the host
+			}
+		}
+		return nil, fmt.Errorf("%w: %w", ErrPartialAcquisition, err)
+	}
+	return conns, nil
+}
+
+// GetConnMeasured is like GetConn but also returns the underlying net.Conn (see Conn.NetConn) wrapped
+// in a MeasuredConn counting the bytes going through it. The connection is still released through Conn.Release,
+// at which point the bytes read and written are reported to statsd.
+// It returns ErrNotNetConn if the underlying user object is not a net.Conn, the connection being released.
+func (s *Service) GetConnMeasured() (*Conn, *MeasuredConn, error) {
+	c, err := s.GetConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	nc := c.NetConn()
+	if nc == nil {
+		c.Release(nil, *s.NeutralScore) // misconfiguration, not the host fault
+		return nil, nil, ErrNotNetConn
+	}
+	c.measured = &MeasuredConn{Conn: nc}
+	return c, c.measured, nil
+}
+
+// Borrow is like GetConn but also returns a release function meant to be deferred (see Conn.Release).
+// Calling the release function more than once is a no-op.
+func (s *Service) Borrow() (*Conn, func(err error, score float64), error) {
+	var once sync.Once
+
+	c, err := s.GetConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func(err error, score float64) {
+		once.Do(func() { c.Release(err, score) })
+	}
+	return c, release, nil
+}
+
+// Do gets a connection from the service and calls fn with it, releasing the connection afterwards.
+// If fn fails with a fatal error (see Driver.Temporary), the host is demoted and fn is retried
+// on another host, up to GetAttempts times. It returns the last error returned by fn.
+func (s *Service) Do(fn func(*Conn) error) error {
+	return s.do(context.Background(), s.getAttemptsMax(), fn)
+}
+
+// Calls fn with a connection from the service, releasing the connection afterwards.
+// If fn fails with a fatal error, the host is demoted and fn is retried on another host, up to retries times.
+func (s *Service) do(ctx context.Context, retries uint, fn func(*Conn) error) error {
+	var last error
+	var opts getOptions
+
+	failed := make(map[*Host]bool)
+	for i := uint(0); ; i++ {
+		c, err := s.getConn(ctx, opts)
+		if err != nil {
+			if last != nil {
+				return last // every host failed
+			}
+			return err
+		}
+		s.applyDeadline(ctx, c)
+
+		h, d := c.host, c.Driver()
+		err = fn(c)
+		if err == nil || d.Temporary(err) {
+			if e := c.Release(err, HostUp); e != nil && err == nil {
+				return e
+			}
+			return err
+		}
+		c.Release(err, HostDown)
+
+		failed[h] = true
+		last = err
+		if i >= retries {
+			return last
+		}
+		opts.filter = func(h *Host) bool { return !failed[h] }
+	}
+}
+
+// ServeConn gets a connection from the service and calls fn with it, releasing the connection afterwards.
+// The host is scored HostUp unless fn fails with a fatal error (see Driver.Temporary), in which case it is demoted.
+// It returns the error returned by fn.
+func (s *Service) ServeConn(ctx context.Context, fn func(*Conn) error) error {
+	return s.do(ctx, 0, fn)
+}
+
+// ServeConnWithScore is like ServeConn but the host is scored according to the score returned by fn.
+// The score is bounded to [0,1], it is forced to HostDown if fn fails with a fatal error (see Conn.Release).
+func (s *Service) ServeConnWithScore(ctx context.Context, fn func(*Conn) (float64, error)) error {
+	c, err := s.GetConnContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	score, err := fn(c)
+	if score < HostDown {
+		score = HostDown
+	} else if score > HostUp {
+		score = HostUp
+	}
+	if e := c.Release(err, score); e != nil && err == nil {
+		return e
+	}
+	return err
+}
+
+// Defragment rearranges the hosts time series in chronological order.
+// No feedback is lost in the process and the hosts scores are left unchanged.
+func (s *Service) Defragment() {
+	for _, h := range s.snapshot() {
+		h.defragment()
+	}
+}
+
+// ExportScores returns the scores learned so far by every host of the service (see Host.Score).
+// Hosts whose score hasn't been computed yet are omitted, none are if the BanditStrategy doesn't use scores
+// (e.g. RoundRobin).
+func (s *Service) ExportScores() map[string]float64 {
+	if s.memoize == nil {
+		return map[string]float64{} // scores aren't computed
+	}
+
+	s.RLock()
+	m := make(map[string]float64, len(s.hosts))
+	for a, h := range s.hosts {
+		if score := h.Score(); score >= 0 {
+			m[a] = score
+		}
+	}
+	s.RUnlock()
+	return m
+}
+
+// ImportScores seeds the scores of the service hosts, typically with ones previously exported (see ExportScores).
+// This shortens the exploration phase after a restart. Only hosts already registered are seeded and
+// scores outside [0,1] are ignored. It does nothing if the BanditStrategy doesn't use scores (e.g. RoundRobin).
+func (s *Service) ImportScores(scores map[string]float64) {
+	s.RLock()
+	for a, score := range scores {
+		h := s.hosts[a]
+		if h == nil || !h.memoized || score < 0 || score > 1 {
+			continue
+		}
+		h.seed(score)
+	}
+	s.RUnlock()
+}
+
+// ResetHostScore discards the feedback recorded so far for a given host, its score is unknown until the next
+// computation (see Host.Score) where it starts afresh from NeutralScore (e.g. to rehabilitate a host once fixed).
+// It returns ErrHostNotFound if the host is not registered to the service.
+func (s *Service) ResetHostScore(address string) error {
+	s.RLock()
+	h := s.hosts[address]
+	s.RUnlock()
+	if h == nil {
+		return ErrHostNotFound
+	}
+	h.reset()
+	return nil
+}
+
+// Status returns every host addresses managed by the service along with
+// the number of connections handled by their respective pool thus far.
+func (s *Service) Status() map[string]int32 {
+	s.RLock()
+	m := make(map[string]int32, len(s.hosts))
+	for a, h := range s.hosts {
+		m[a] = h.pool.ActiveConns()
+	}
+	s.RUnlock()
+	return m
+}
+
+// Metrics returns a snapshot of the service metrics.
+// It provides the same data as the one sent to statsd without requiring a statsd server.
+func (s *Service) Metrics() (m ServiceMetrics) {
+	m.GetConns = atomic.LoadUint64(&s.getCount)
+	m.GetFails = atomic.LoadUint64(&s.getFails)
+	m.GetAttempts = atomic.LoadUint64(&s.getAttempts)
+
+	s.RLock()
+	m.Hosts = len(s.hosts)
+	m.Selections = make(map[string]uint64, len(s.hosts))
+	for a, h := range s.hosts {
+		m.Conns += int64(h.pool.ActiveConns())
+		m.Selections[a] = atomic.LoadUint64(&h.selections)
+	}
+	s.RUnlock()
+	return
+}
+
+// ConnectionDistribution returns the fraction of the service connections spawned by each host (see Pool.ActiveConns).
+// It returns an empty map if there is no connection.
+func (s *Service) ConnectionDistribution() map[string]float64 {
+	var total int32
+
+	s.RLock()
+	counts := make(map[string]int32, len(s.hosts))
+	for a, h := range s.hosts {
+		counts[a] = h.pool.ActiveConns()
+		total += counts[a]
+	}
+	s.RUnlock()
+
+	m := make(map[string]float64, len(counts))
+	if total == 0 {
+		return m
+	}
+	for a, n := range counts {
+		m[a] = float64(n) / float64(total)
+	}
+	return m
+}
+
+// Returns the number of goroutines waiting for a connection across all the hosts pools.
+func (s *Service) waiters() (n int) {
+	s.RLock()
+	for _, h := range s.hosts {
+		n += h.pool.Waiters()
+	}
+	s.RUnlock()
+	return
+}
+
+// MaxCapacityUsedPercent returns the highest capacity used among the hosts pools (see Pool.CapacityUsedPercent).
+func (s *Service) MaxCapacityUsedPercent() (pct float32) {
+	s.RLock()
+	for _, h := range s.hosts {
+		if p := h.pool.CapacityUsedPercent(); p > pct {
+			pct = p
+		}
+	}
+	s.RUnlock()
+	return
+}
+
+// InFlight returns the connections currently checked out from the service, along with where they were acquired.
+// It requires TrackInFlight to be set, connections held for too long (see InFlightInfo.Age) are likely leaked.
+func (s *Service) InFlight() []InFlightInfo {
+	return s.inflight.list()
+}
+
+// Rebind redirects a given host to a new address, preserving its score history.
+// Idle connections to the old address are closed and renewed, checked out ones are renewed once released.
+// Session keys bound to the host connections (see GetConnWithStickinessKey) remain bound to the host.
+// It returns ErrHostNotFound if the host is not registered and ErrInvalidArg if the new address already is.
+func (s *Service) Rebind(oldAddr, newAddr string) error {
+	if newAddr == "" {
+		return ErrInvalidArg
+	}
+
+	s.Lock()
+	h := s.hosts[oldAddr]
+	if h == nil {
+		s.Unlock()
+		return ErrHostNotFound
+	}
+	if oldAddr == newAddr {
+		s.Unlock()
+		return nil
+	}
+	if s.hosts[newAddr] != nil {
+		s.Unlock()
+		return ErrInvalidArg
+	}
+	s.unsetHost(oldAddr)
+	s.setHost(newAddr, h)
+	s.Unlock()
+
+	// XXX rebind the pool outside of the service lock in order not to stall GetConn operations,
+	// connections to the old address might still be handed out meanwhile
+	if err := h.pool.SetAddress(newAddr); err != nil {
+		return err
+	}
+	s.rebindSessions(h)
+	return nil
+}
+
+// ForceRemoveAll removes all the hosts from the service right away and forcefully closes their pools concurrently
+// (see Pool.ForceClose). Idle connections are closed while checked out connections are abandoned, a warning is logged
+// for each of them if TrackInFlight is set. Like RemoveAll, the service remains usable and new hosts can be added afterwards.
+func (s *Service) ForceRemoveAll() {
+	var w sync.WaitGroup
+
+	s.Lock()
+	hosts := s.hosts
+	s.resetHosts()
+	s.Unlock()
+	s.uncache()
+
+	inflight := make(map[string][]InFlightInfo)
+	for _, i := range s.InFlight() {
+		inflight[i.Address] = append(inflight[i.Address], i)
+	}
+
+	w.Add(len(hosts))
+	for a, h := range hosts {
+		s.unbindSessions(h)
+		close(h.quit)
+		go func(a string, h *Host) {
+			defer w.Done()
+			h.pool.abort()
+			for _, i := range inflight[a] {
+				s.Logger.Printf("pooly: service %s: WARNING: abandoned connection #%d to %s checked out for %v",
+					s.name, i.ID, a, i.Age.Round(time.Millisecond))
+			}
+		}(a, h)
+	}
+	w.Wait()
+}
+
+// ReconfigureHost replaces the pool of a given host with a new one using the given configuration (e.g. new timeouts
+// or driver), while preserving the host score. Subsequent GetConn operations are served by the new pool, whereas
+// the old one is drained in background as connections checked out from it are released (see CloseDeadline).
+// It returns ErrHostNotFound if the host is not registered to the service.
+func (s *Service) ReconfigureHost(address string, cfg *PoolConfig) error {
+	if cfg == nil {
+		return ErrInvalidArg
+	}
+	c := *cfg
+	p := NewPool(address, &c)
+	p.setIDs(&s.lastConnID)
+	p.setStats(s.stats)
+
+	s.Lock()
+	old := s.hosts[address]
+	if old == nil {
+		s.Unlock()
+		p.Close()
+		return ErrHostNotFound
+	}
+	h := old.clone(p)
+	s.setHost(address, h)
+	s.Unlock()
+	s.uncache()
+
+	p.New(s.prespawnConns())
+	if s.AutoReconnect {
+		go s.reconnect(h)
+	}
+	s.unbindSessions(old)
+	s.drain(old)
+	return nil
+}
+
+// Saturated returns true if the pools of all the hosts are saturated (i.e. MaxConns is reached and every connection is checked out),
+// meaning that GetConn would have to wait for a connection to be released. It returns false if there is no host.
+func (s *Service) Saturated() bool {
+	s.RLock()
+	defer s.RUnlock()
+	for _, h := range s.hosts {
+		if !h.pool.saturated() {
+			return false
+		}
+	}
+	return len(s.hosts) > 0
+}
+
+// Len returns the number of hosts registered to the service.
+func (s *Service) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.hosts)
+}
+
+// AllConnsIdle returns true if no connection is currently checked out from the service.
+func (s *Service) AllConnsIdle() bool {
+	s.RLock()
+	defer s.RUnlock()
+	for _, h := range s.hosts {
+		if !h.pool.empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitForIdle waits until no connection is checked out from the service (see AllConnsIdle),
+// every host pool being waited on concurrently (see Pool.WaitEmpty).
+// It returns the context error if the given context is done beforehand.
+func (s *Service) WaitForIdle(ctx context.Context) error {
+	var w sync.WaitGroup
+
+	hosts := s.snapshot()
+	errs := make(chan error, len(hosts))
+	w.Add(len(hosts))
+	for _, h := range hosts {
+		go func(p *Pool) {
+			defer w.Done()
+			if err := p.WaitEmpty(ctx); err != nil {
+				errs <- err
+			}
+		}(h.pool)
+	}
+	w.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// WaitReadyN waits until every host of the service has at least minPerHost connections established,
+// spawning new ones as needed. This allows to absorb an initial burst of requests without dialing.
+// It returns the context error if the given context is done beforehand.
+func (s *Service) WaitReadyN(ctx context.Context, minPerHost int) error {
+	s.RLock() // defaults are filled by NewPool under the lock
+	max := s.MaxConns
+	s.RUnlock()
+	if max <= 0 {
+		max = DefaultMaxConns // no host added yet
+	}
+	if minPerHost < 0 || minPerHost > int(max) {
+		return ErrInvalidArg
+	}
+
+	t := time.NewTicker(1 * time.Millisecond)
+	defer t.Stop()
+	for {
+		ready := true
+		for _, h := range s.snapshot() {
+			if n := int(h.pool.ActiveConns()); n < minPerHost {
+				h.pool.New(uint(minPerHost - n))
+			}
+			if int(h.pool.establishedConns()) < minPerHost {
+				ready = false
+			}
+		}
+		if ready {
+			return nil
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 // Close closes the service, thus destroying all hosts and their respective pool.
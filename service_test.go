@@ -1,7 +1,17 @@
 package pooly
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cactus/go-statsd-client/statsd"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -148,3 +158,3263 @@ func TestHostScore(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestConnReleaseAllocs(t *testing.T) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}})
+	h := newTestHost(p)
+	c := NewConn(nil)
+
+	n := testing.AllocsPerRun(100, func() {
+		c.setHost(h)
+		if err := c.Release(nil, HostUp); err != nil {
+			t.Fatal(err)
+		}
+		p.dequeue(<-p.conns)
+	})
+	if n != 0 {
+		t.Fatal("no allocation expected, got", n)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkConnRelease(b *testing.B) {
+	p := NewPool(echo1, &PoolConfig{Driver: nopDriver{}})
+	h := newTestHost(p)
+	c := NewConn(nil)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.setHost(h)
+		c.Release(nil, HostUp)
+		p.dequeue(<-p.conns)
+	}
+}
+
+func TestServiceGetConnTimeout(t *testing.T) {
+	e := newEchoServer(t, echo2)
+	defer e.close()
+
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.GetConnTimeout(0); err != ErrInvalidArg {
+		t.Fatal("invalid argument expected")
+	}
+
+	s.Add(echo1) // no server listening
+	if _, err := s.GetConnTimeout(10 * time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatal("deadline exceeded expected, got", err)
+	}
+
+	s.Remove(echo1)
+	s.Add(echo2)
+	c, err := s.GetConnTimeout(1 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slowComputer computes scores slowly, signaling when it does.
+type slowComputer struct {
+	delay     time.Duration
+	computing chan struct{}
+}
+
+func (c slowComputer) Compute(score float64) float64 {
+	select {
+	case c.computing <- struct{}{}:
+	default:
+	}
+	time.Sleep(c.delay)
+	return score
+}
+
+func TestServiceRemoveWhileScoring(t *testing.T) {
+	computer := slowComputer{1 * time.Millisecond, make(chan struct{}, 1)}
+	s, err := NewService("nop", &ServiceConfig{
+		PoolConfig:           PoolConfig{Driver: nopDriver{}},
+		MemoizeScoreDuration: 1 * time.Millisecond,
+		ScoreCalculator:      computer,
+		BanditStrategy:       NewEpsilonGreedy(0.1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		s.Add(fmt.Sprintf("host%d", i))
+	}
+	<-computer.computing // scores computation started
+
+	s.Remove("host0")
+	waitUntil(t, func() bool {
+		_, ok := s.Status()["host0"]
+		return !ok
+	})
+}
+
+func TestServiceDo(t *testing.T) {
+	var addrs []string
+
+	e1 := newEchoServer(t, echo1)
+	defer e1.close()
+	e2 := newEchoServer(t, echo2)
+	defer e2.close()
+
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+	s.Add(echo2)
+	time.Sleep(1 * time.Millisecond) // wait for propagation
+
+	err = s.Do(func(c *Conn) error {
+		addrs = append(addrs, c.Address())
+		if len(addrs) == 1 {
+			return errors.New("") // fake a fatal operation failure
+		}
+		return ping(c.NetConn())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || addrs[0] == addrs[1] {
+		t.Fatal("retry on another host expected:", addrs)
+	}
+}
+
+func TestConnDriver(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: testDriver},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Driver() != testDriver {
+		t.Fatal("custom driver expected")
+	}
+	if err := c.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+	if c.Driver() != nil {
+		t.Fatal("no driver expected after release")
+	}
+	if NewConn(nil).Driver() != nil {
+		t.Fatal("no driver expected on detached connection")
+	}
+}
+
+func TestHostScoreInvalidation(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", &ServiceConfig{
+		MemoizeScoreDuration: 1 * time.Hour,
+		BanditStrategy:       NewEpsilonGreedy(0.1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.host
+	if err := c.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+	h.computeScore(nil)
+	if h.Score() <= 0 {
+		t.Fatal("positive score expected")
+	}
+
+	c, err = s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Release(errors.New(""), HostUp); err != nil { // fake a fatal operation failure
+		t.Fatal(err)
+	}
+	if st := h.Stats(); st.Score != -1 || st.ScoreAge > 1*time.Second {
+		t.Fatal("invalidated score expected:", st)
+	}
+}
+
+func TestHostDefragment(t *testing.T) {
+	h := newTestHost(NewPool(echo1, &PoolConfig{Driver: nopDriver{}}))
+	defer h.pool.Close()
+
+	trials := func() (n uint32) {
+		for _, s := range h.timeSeries {
+			n += s.trials
+		}
+		return
+	}
+
+	for i := 0; i < seriesNum+10; i++ {
+		h.decay()
+		if i >= seriesNum-5 && i%2 == 0 {
+			h.rate(float64(i%3) / 2)
+		}
+	}
+	h.computeScore(nil)
+	score := h.Score()
+	n := trials()
+	slot := h.TrialsInSlot(2)
+
+	h.defragment()
+	if len(h.timeSeries) != seriesNum || h.timeSlot != seriesNum-1 {
+		t.Fatal("chronological time series expected:", len(h.timeSeries), h.timeSlot)
+	}
+	if trials() != n || h.TrialsInSlot(2) != slot {
+		t.Fatal("trials lost during defragmentation")
+	}
+	h.computeScore(nil)
+	if h.Score() != score {
+		t.Fatal("identical score expected after defragmentation:", h.Score(), score)
+	}
+
+	// Defragmentation is stable once done
+	h.defragment()
+	h.computeScore(nil)
+	if h.Score() != score || trials() != n {
+		t.Fatal("stable score expected")
+	}
+
+	h.decay()
+	h.rate(HostUp)
+	if trials() != n+1 || h.TrialsInSlot(0) != 1 {
+		t.Fatal("time series usable after defragmentation expected")
+	}
+}
+
+func TestHostCheckoutPercentiles(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+
+	var h *Host
+	for i := 0; i < 100; i++ {
+		c, err := s.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h = c.host
+		held := 1 * time.Millisecond
+		if i >= 80 {
+			held = 100 * time.Millisecond
+		}
+		c.gottenAt = time.Now().Add(-held) // fake the checkout duration
+		if err := c.Release(nil, HostUp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := h.Stats()
+	if st.CheckoutP50 < 1*time.Millisecond || st.CheckoutP50 > 2*time.Millisecond {
+		t.Fatal("p50 of ~1ms expected:", st.CheckoutP50)
+	}
+	if st.CheckoutP90 < 100*time.Millisecond || st.CheckoutP90 > 200*time.Millisecond {
+		t.Fatal("p90 of ~100ms expected:", st.CheckoutP90)
+	}
+	if st.CheckoutP99 < st.CheckoutP90 {
+		t.Fatal("ordered percentiles expected")
+	}
+
+	h.decay()
+	if h.Stats().CheckoutP50 != st.CheckoutP50 {
+		t.Fatal("percentiles unchanged by decay expected")
+	}
+}
+
+func TestHostCheckoutDecayRoundRobin(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:     PoolConfig{Driver: nopDriver{}},
+		BanditStrategy: NewRoundRobin(),
+		DecayDuration:  seriesNum * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.host
+	if err := c.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+
+	checkouts := func() (n float64) {
+		h.RLock()
+		for _, c := range h.checkouts {
+			n += c
+		}
+		h.RUnlock()
+		return
+	}
+	deadline := time.After(1 * time.Second)
+	for checkouts() >= 1 {
+		select {
+		case <-deadline:
+			t.Fatal("checkouts decayed expected")
+		default:
+			time.Sleep(1 * time.Millisecond)
+		}
+	}
+}
+
+func TestHostTrials(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+
+	var h *Host
+	for cycle := 1; cycle <= 3; cycle++ {
+		for i := 0; i < cycle; i++ {
+			c, err := s.GetConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h = c.host
+			if err := c.Release(nil, HostUp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := h.TrialsInSlot(0); n != uint32(cycle) {
+			t.Fatal(cycle, "trials expected in current slot, got", n)
+		}
+		h.decay()
+	}
+
+	if n := h.Trials(); n != 6 {
+		t.Fatal("6 trials expected, got", n)
+	}
+	if h.TrialsInSlot(0) != 0 || h.TrialsInSlot(1) != 3 || h.TrialsInSlot(2) != 2 || h.TrialsInSlot(3) != 1 {
+		t.Fatal("trials per slot mismatch")
+	}
+	if h.TrialsInSlot(-1) != 0 || h.TrialsInSlot(seriesNum) != 0 {
+		t.Fatal("no trials expected out of range")
+	}
+}
+
+func TestServiceNeutralScore(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	invalid := 1.5
+	if _, err := NewService("echo", &ServiceConfig{NeutralScore: &invalid}); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+
+	score := func(neutral float64) float64 {
+		s, err := NewService("echo", &ServiceConfig{
+			NeutralScore:   &neutral,
+			BanditStrategy: NewEpsilonGreedy(0.1),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if _, err := s.AddSync(echo1); err != nil {
+			t.Fatal(err)
+		}
+		s.RLock()
+		h := s.hosts[echo1]
+		s.RUnlock()
+
+		// Sparse sampling, a single feedback followed by empty slots
+		h.rate(HostUp)
+		for i := 0; i < 10; i++ {
+			h.decay()
+		}
+		h.computeScore(nil)
+		return h.Score()
+	}
+
+	zero, low, mid, high := score(0), score(0.2), score(DefaultNeutralScore), score(0.8)
+	if !(zero < low && low < mid && mid < high) {
+		t.Fatal("scores ordered by neutral value expected:", zero, low, mid, high)
+	}
+	if high > 1 || low < 0.2 {
+		t.Fatal("scores out of bounds:", low, high)
+	}
+
+	// Unscored slots are treated as down with a zero neutral value
+	if math.Abs(zero-1.0/66) > 1e-9 {
+		t.Fatal("score of the single feedback expected:", zero)
+	}
+}
+
+func TestHostDecayElapsed(t *testing.T) {
+	const interval = 10 * time.Millisecond
+
+	h := newTestHost(NewPool(echo1, &PoolConfig{Driver: nopDriver{}}))
+	defer h.pool.Close()
+
+	now := time.Now()
+	h.decayAt(now, interval) // first decay, nothing to catch up
+	h.rate(HostUp)
+
+	// On time tick
+	now = now.Add(interval + interval/10)
+	h.decayAt(now, interval)
+	if h.TrialsInSlot(1) != 1 || len(h.timeSeries) != 3 {
+		t.Fatal("1 slot advanced expected")
+	}
+
+	// Delayed ticks, 3 intervals elapsed
+	now = now.Add(3*interval + interval/5)
+	h.decayAt(now, interval)
+	if h.TrialsInSlot(4) != 1 || len(h.timeSeries) != 6 {
+		t.Fatal("3 slots advanced expected")
+	}
+
+	// Early tick still advances one slot
+	now = now.Add(interval / 5)
+	h.decayAt(now, interval)
+	if h.TrialsInSlot(5) != 1 {
+		t.Fatal("1 slot advanced expected")
+	}
+
+	// The whole time series is outdated
+	now = now.Add(2 * seriesNum * interval)
+	h.decayAt(now, interval)
+	if h.Trials() != 0 {
+		t.Fatal("no trials left expected")
+	}
+}
+
+func TestServiceBorrow(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+
+	c, release, err := s.Borrow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(c.NetConn()); err != nil {
+		t.Fatal(err)
+	}
+	release(nil, HostUp)
+	if c.host != nil {
+		t.Fatal("released connection expected")
+	}
+
+	d, err := s.GetConn() // may reuse the same connection
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(nil, HostUp)
+	if d.host == nil {
+		t.Fatal("release no-op expected")
+	}
+	if err := d.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceGetConnDebug(t *testing.T) {
+	e1 := newEchoServer(t, echo1)
+	defer e1.close()
+	e2 := newEchoServer(t, echo2)
+	defer e2.close()
+
+	strategies := map[string]Selecter{
+		"RoundRobin":    NewRoundRobin(),
+		"EpsilonGreedy": NewEpsilonGreedy(0.1),
+		"SoftMax":       NewSoftMax(0.2),
+	}
+	for name, strategy := range strategies {
+		s, err := NewService("echo", &ServiceConfig{
+			BanditStrategy: strategy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Add(echo1)
+		s.Add(echo2)
+		time.Sleep(1 * time.Millisecond) // wait for propagation
+
+		c, d, err := s.GetConnDebug()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.SelectedHost != c.Address() || d.AttemptCount != 1 || d.StrategyName != name {
+			t.Fatal("bad debug info:", d)
+		}
+		if _, ok := d.HostScores[echo1]; !ok || len(d.HostScores) != 2 {
+			t.Fatal("hosts scores expected:", d.HostScores)
+		}
+		if name == "RoundRobin" && (d.HostScores[echo1] != -1 || d.HostScores[echo2] != -1) {
+			t.Fatal("unscored hosts expected:", d.HostScores)
+		}
+		if d.SelectionLatency <= 0 || d.SelectionLatency > 1*time.Second {
+			t.Fatal("bad selection latency:", d.SelectionLatency)
+		}
+		if err := c.Release(nil, HostUp); err != nil {
+			t.Fatal(err)
+		}
+		if name == "RoundRobin" { // once scheduled, hosts are still reported unscored
+			c, d, err := s.GetConnDebug()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.HostScores[echo1] != -1 || d.HostScores[echo2] != -1 {
+				t.Fatal("unscored hosts expected:", d.HostScores)
+			}
+			c.Release(nil, HostUp)
+			if st := s.hosts[echo1].Stats(); st.Score != -1 {
+				t.Fatal("unscored host stats expected, got", st.Score)
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestServiceImportScores(t *testing.T) {
+	e1 := newEchoServer(t, echo1)
+	defer e1.close()
+	e2 := newEchoServer(t, echo2)
+	defer e2.close()
+
+	s, err := NewService("echo", &ServiceConfig{
+		BanditStrategy: NewEpsilonGreedy(0), // always exploit
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+
+	s.RLock()
+	s.hosts[echo1].rate(0.1)
+	s.hosts[echo2].rate(0.9)
+	s.RUnlock()
+
+	var scores map[string]float64
+	waitUntil(t, func() bool { // wait for scores computation
+		scores = s.ExportScores()
+		return len(scores) == 2
+	})
+	s.Close()
+	if scores[echo2] <= scores[echo1] {
+		t.Fatal("bad scores exported:", scores)
+	}
+
+	s, err = NewService("echo", &ServiceConfig{
+		BanditStrategy: NewEpsilonGreedy(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+
+	s.ImportScores(scores)
+	for i := 0; i < 10; i++ {
+		c, err := s.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := c.Address()
+		if err := c.Release(nil, HostUp); err != nil {
+			t.Fatal(err)
+		}
+		if a != echo2 {
+			t.Fatal(echo2, "expected")
+		}
+	}
+}
+
+func TestServiceExportScoresRoundRobin(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+	for i := 0; i < 4; i++ {
+		c, err := s.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Release(nil, HostUp)
+	}
+	if scores := s.ExportScores(); len(scores) != 0 {
+		t.Fatal("no score exported expected, got", scores)
+	}
+}
+
+func TestServiceDialBestNotNetConn(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	if _, err := s.DialBest(); err != ErrNotNetConn {
+		t.Fatal("not a net.Conn error expected, got", err)
+	}
+	waitUntil(t, s.AllConnsIdle) // the connection released and the prespawned ones dialed
+	s.RLock()
+	h := s.hosts[echo1]
+	s.RUnlock()
+	h.computeScore(nil)
+	if score := h.Score(); score != DefaultNeutralScore {
+		t.Fatal("neutral score expected, got", score)
+	}
+}
+
+func TestServiceDialBest(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+
+	nc, err := s.DialBest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(nc); err != nil {
+		t.Fatal(err)
+	}
+	c := nc.(*releaseWrapper).conn
+	if err := nc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.host != nil {
+		t.Fatal("released connection expected")
+	}
+}
+
+// flakyConn fails every other read with a temporary error.
+type flakyConn struct {
+	net.Conn
+	reads int
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (f *flakyConn) Read(b []byte) (int, error) {
+	f.reads++
+	if f.reads%2 == 0 {
+		return 0, temporaryError{}
+	}
+	return len(b), nil
+}
+
+func TestServiceDialBestDegradedScore(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+
+	nc, err := s.DialBest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := nc.(*releaseWrapper)
+	w.Conn = &flakyConn{Conn: w.Conn}
+	h := w.conn.host
+
+	b := make([]byte, 4)
+	for i := 0; i < 4; i++ {
+		nc.Read(b)
+	}
+	if err := nc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h.RLock()
+	score := h.timeSeries[h.timeSlot].score
+	h.RUnlock()
+	if score != 0.5 {
+		t.Fatal("score of 0.5 expected, got", score)
+	}
+	if h.pool.ActiveConns() == 0 {
+		t.Fatal("connection kept on temporary errors expected")
+	}
+}
+
+// fixedSelecter selects a given host whenever possible.
+type fixedSelecter string
+
+func (f fixedSelecter) Select(hosts map[string]*Host) *Host {
+	if h, ok := hosts[string(f)]; ok {
+		return h
+	}
+	for _, h := range hosts {
+		return h
+	}
+	return nil
+}
+
+// gatedDriver spawns connections without any underlying network activity, dialing a given address once the gate opens.
+// Dials waiting for the gate are signaled on dialing, if any.
+type gatedDriver struct {
+	nopDriver
+	address string
+	gate    chan struct{}
+	dialing chan struct{}
+}
+
+func (d gatedDriver) Dial(a string) (*Conn, error) {
+	if a == d.address {
+		if d.dialing != nil {
+			d.dialing <- struct{}{}
+		}
+		<-d.gate
+	}
+	return d.nopDriver.Dial(a)
+}
+
+func TestServiceGetConnHedged(t *testing.T) {
+	gate := make(chan struct{})
+	defer close(gate)
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:     PoolConfig{Driver: gatedDriver{address: echo1, gate: gate}, MaxConns: 1},
+		BanditStrategy: fixedSelecter(echo1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1) // the first host never serves until the gate opens
+	s.AddSync(echo2)
+
+	c, err := s.GetConnHedged(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address() != echo2 {
+		t.Fatal(echo2, "expected, got", c.Address())
+	}
+
+	// Only the hedged attempt is accounted for
+	m := s.Metrics()
+	if m.GetConns != 1 || m.GetAttempts != 1 || m.Selections[echo1] != 0 || m.Selections[echo2] != 1 {
+		t.Fatal("single accounted attempt expected:", m)
+	}
+	if err := c.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceGetConnHedgedSelectsOnce(t *testing.T) {
+	var selected []string
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+		OnSelect: func(addr string, score float64) {
+			selected = append(selected, addr)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+
+	c, err := s.GetConnHedged(1 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0] != echo1 {
+		t.Fatal("single selection of", echo1, "reported expected, got", selected)
+	}
+	if n := s.Metrics().Selections[echo1]; n != 1 {
+		t.Fatal("1 selection expected, got", n)
+	}
+	c.Release(nil, HostUp)
+}
+
+func TestServiceAllConnsIdle(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.AllConnsIdle() {
+		t.Fatal("connection checked out expected")
+	}
+	if err := c.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.WaitForIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !s.AllConnsIdle() {
+		t.Fatal("all connections idle expected")
+	}
+}
+
+func TestServiceAllConnsIdleTimedOut(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}, ConnIdleTimeout: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetPrespawnConns(0)
+	s.AddSync(echo1)
+	events := s.hosts[echo1].pool.Events()
+
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Release(nil, HostUp)
+	waitCollected(t, events, c)
+
+	// The slot of the connection timed out is still queued
+	if !s.AllConnsIdle() {
+		t.Fatal("all connections idle expected")
+	}
+	if err := s.WaitForIdle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceMaxHosts(t *testing.T) {
+	s, err := NewService("nop", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+		MaxHosts:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.AddSync(echo1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddSync(echo2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddSync(echo3); err != ErrMaxHostsReached {
+		t.Fatal("maximum hosts reached expected")
+	}
+	if _, err := s.AddSync(echo1); err != nil {
+		t.Fatal(err)
+	}
+
+	m := s.Status()
+	if _, ok := m[echo3]; ok || len(m) != 2 {
+		t.Fatal("bad status:", m)
+	}
+}
+
+func TestServiceWaitReadyN(t *testing.T) {
+	e1 := newEchoServer(t, echo1)
+	defer e1.close()
+	e2 := newEchoServer(t, echo2)
+	defer e2.close()
+
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+	s.Add(echo2)
+	time.Sleep(1 * time.Millisecond) // wait for propagation
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := s.WaitReadyN(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	s.RLock()
+	for a, h := range s.hosts {
+		if n := h.pool.IdleConns(); n < 5 {
+			t.Fatal(a, ": 5 connections established expected, got", n)
+		}
+	}
+	s.RUnlock()
+
+	if err := s.WaitReadyN(ctx, DefaultMaxConns+1); err != ErrInvalidArg {
+		t.Fatal("invalid argument expected")
+	}
+}
+
+func TestServiceRetryBackoff(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		GetAttempts:        5,
+		GetRetryBackoff:    2 * time.Millisecond,
+		GetRetryMaxBackoff: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	bounds := []time.Duration{0, 2, 4, 8, 10, 10}
+	for a := uint(1); a < uint(len(bounds)); a++ {
+		max := bounds[a] * time.Millisecond
+		if d := s.retryBackoff(a); d < max/2 || d > max {
+			t.Fatalf("attempt %d: backoff in [%v,%v] expected, got %v", a, max/2, max, d)
+		}
+	}
+
+	// Concurrent callers don't retry in lockstep
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 10; i++ {
+		delays[s.retryBackoff(3)] = true
+	}
+	if len(delays) < 2 {
+		t.Fatal("jittered backoffs expected")
+	}
+}
+
+// refusingDriver records the time of every dial and fails them all.
+type refusingDriver struct {
+	nopDriver
+	sync.Mutex
+	dials []time.Time
+}
+
+func (d *refusingDriver) Dial(string) (*Conn, error) {
+	d.Lock()
+	d.dials = append(d.dials, time.Now())
+	d.Unlock()
+	return nil, errors.New("connection refused")
+}
+
+func TestServiceRetryBackoffConcurrent(t *testing.T) {
+	const callers = 20
+	var w sync.WaitGroup
+
+	d := &refusingDriver{}
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:         PoolConfig{Driver: d, ConnRetries: 1},
+		DialBudget:         1 * time.Millisecond,
+		GetAttempts:        1,
+		GetRetryBackoff:    40 * time.Millisecond,
+		GetRetryMaxBackoff: 40 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetPrespawnConns(0)
+	s.AddSync(echo1)
+
+	w.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			s.GetConn()
+			w.Done()
+		}()
+	}
+	w.Wait()
+
+	// Every caller dials once, then once more after its backoff in [20ms,40ms]
+	d.Lock()
+	dials := append([]time.Time(nil), d.dials...)
+	d.Unlock()
+	if len(dials) != 2*callers {
+		t.Fatal(2*callers, "dials expected, got", len(dials))
+	}
+	sort.Slice(dials, func(i, j int) bool { return dials[i].Before(dials[j]) })
+	if spread := dials[len(dials)-1].Sub(dials[callers]); spread < 5*time.Millisecond {
+		t.Fatal("retries spread by the jitter expected, got", spread)
+	}
+}
+
+func TestServiceAutoReconnect(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{
+			ConnRetries: 1,
+			RetryDelay:  1 * time.Millisecond,
+		},
+		AutoReconnect:    true,
+		ReconnectBackoff: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Add(echo1) // no server listening
+	time.Sleep(20 * time.Millisecond)
+
+	e := newEchoServer(t, echo1)
+	defer e.close()
+	defer s.Close()
+
+	s.RLock()
+	h := s.hosts[echo1]
+	s.RUnlock()
+	for i := 0; h.pool.establishedConns() == 0; i++ {
+		if i == 100 {
+			t.Fatal("automatic reconnection expected")
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestServiceMetrics(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:  PoolConfig{WaitTimeout: 10 * time.Millisecond, ConnRetries: 1},
+		GetAttempts: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.AddSync(echo1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		c, err := s.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Release(nil, HostUp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := s.Metrics()
+	if m.GetConns != 3 || m.GetAttempts != 3 || m.GetFails != 0 {
+		t.Fatal("bad get counters:", m)
+	}
+	if m.Hosts != 1 || m.Conns < 1 {
+		t.Fatal("bad host and connection counts:", m)
+	}
+
+	s.Remove(echo1)
+	if _, err := s.AddSync(echo3); err != nil { // no server listening
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Millisecond) // wait for propagation
+	if _, err := s.GetConn(); err == nil {
+		t.Fatal("connection failure expected")
+	}
+	m = s.Metrics()
+	if m.GetConns != 3 || m.GetAttempts != 5 || m.GetFails != 2 {
+		t.Fatal("bad get counters after failures:", m)
+	}
+	if m.Hosts != 1 {
+		t.Fatal("1 host expected:", m)
+	}
+}
+
+func TestServiceSelectionCache(t *testing.T) {
+	var c countingSelecter
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:        PoolConfig{Driver: nopDriver{}},
+		SelectionCacheTTL: 50 * time.Millisecond,
+		BanditStrategy:    &c,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.AddSync(echo1); err != nil {
+		t.Fatal(err)
+	}
+	h := s.selectHost(&getOptions{})
+	for i := 0; i < 10; i++ {
+		if s.selectHost(&getOptions{}) != h {
+			t.Fatal("cached host expected")
+		}
+	}
+	if c != 1 {
+		t.Fatal("single selection expected, got", c)
+	}
+
+	time.Sleep(60 * time.Millisecond) // wait for the cache to expire
+	s.selectHost(&getOptions{})
+	if c != 2 {
+		t.Fatal("new selection expected after TTL, got", c)
+	}
+
+	s.Remove(echo1)
+	if _, err := s.AddSync(echo2); err != nil {
+		t.Fatal(err)
+	}
+	if s.selectHost(&getOptions{}) == h {
+		t.Fatal("removed host selected from cache")
+	}
+}
+
+func benchmarkServiceSelect(b *testing.B, ttl time.Duration) {
+	s, err := NewService("bench", &ServiceConfig{
+		PoolConfig:        PoolConfig{Driver: nopDriver{}},
+		SelectionCacheTTL: ttl,
+		BanditStrategy:    NewSoftMax(0.1),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		if _, err := s.AddSync(fmt.Sprint("host", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.selectHost(&getOptions{})
+		}
+	})
+}
+
+func BenchmarkServiceSelect(b *testing.B)       { benchmarkServiceSelect(b, 0) }
+func BenchmarkServiceSelectCached(b *testing.B) { benchmarkServiceSelect(b, 1*time.Millisecond) }
+
+func TestServiceGetConnWithStickinessKey(t *testing.T) {
+	e1 := newEchoServer(t, echo1)
+	defer e1.close()
+	e2 := newEchoServer(t, echo2)
+	defer e2.close()
+
+	store := NewInMemorySessionStore()
+	s, err := NewService("echo", &ServiceConfig{
+		PrespawnConns: 3,
+		SessionStore:  store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+	s.Add(echo2)
+	time.Sleep(5 * time.Millisecond) // wait for connections to be spawned
+
+	c, err := s.GetConnWithStickinessKey("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, addr := c.ID(), c.host.pool.Address()
+	if i, ok := store.Get("session"); !ok || i != id {
+		t.Fatal("session bound to the connection expected")
+	}
+	if err := c.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		c, err := s.GetConnWithStickinessKey("session")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ID() != id || c.host.pool.Address() != addr {
+			t.Fatal("sticky connection expected")
+		}
+		if err := c.Release(nil, HostUp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Bound connection checked out, fall back to another one
+	c, err = s.GetConnWithStickinessKey("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := s.GetConnWithStickinessKey("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == c {
+		t.Fatal("borrowed connection handed out twice")
+	}
+	if i, _ := store.Get("session"); i != d.ID() {
+		t.Fatal("session rebound to the new connection expected")
+	}
+	if c.ID() == d.ID() {
+		t.Fatal("connection IDs unique within the service expected")
+	}
+	addr = d.Address()
+	c.Release(nil, HostUp)
+	d.Release(nil, HostUp)
+
+	// Session unbound once its host is removed
+	s.Remove(addr)
+	deadline := time.Now().Add(1 * time.Second)
+	for {
+		if _, ok := store.Get("session"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session deleted from the store expected")
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestServiceMaxCapacityUsedPercent(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:    PoolConfig{Driver: nopDriver{}, MaxConns: 2},
+		PrespawnConns: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if pct := s.MaxCapacityUsedPercent(); pct != 0 {
+		t.Fatal("0% expected, got", pct)
+	}
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+	if pct := s.MaxCapacityUsedPercent(); pct != 50 {
+		t.Fatal("50% expected, got", pct)
+	}
+
+	s.RLock()
+	s.hosts[echo2].pool.New(1)
+	s.RUnlock()
+	if pct := s.MaxCapacityUsedPercent(); pct != 100 {
+		t.Fatal("100% expected, got", pct)
+	}
+}
+
+func TestServiceInFlight(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:    PoolConfig{Driver: nopDriver{}},
+		TrackInFlight: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+
+	leaked, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+
+	l := s.InFlight()
+	if len(l) != 1 {
+		t.Fatal("1 connection in flight expected, got", len(l))
+	}
+	if l[0].ID != leaked.ID() || l[0].Address != echo1 || l[0].Age <= 0 {
+		t.Fatal("bad in flight information:", l[0])
+	}
+	if !strings.Contains(l[0].Stack, "TestServiceInFlight") {
+		t.Fatal("acquisition stack expected, got", l[0].Stack)
+	}
+
+	leaked.Release(nil, HostUp)
+	if n := len(s.InFlight()); n != 0 {
+		t.Fatal("no connection in flight expected, got", n)
+	}
+}
+
+func TestServiceGetConnFrom(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:  PoolConfig{Driver: nopDriver{}},
+		GetAttempts: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+
+	for i := 0; i < 5; i++ {
+		c, err := s.GetConnFrom(echo2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := c.host.pool.Address(); a != echo2 {
+			t.Fatal(echo2, "expected, got", a)
+		}
+		h := c.host
+		if err := c.Release(nil, HostUp); err != nil {
+			t.Fatal(err)
+		}
+		if h.TrialsInSlot(0) != uint32(i+1) {
+			t.Fatal("host scored on release expected")
+		}
+	}
+
+	if _, err := s.GetConnFrom(echo3); err != ErrHostNotFound {
+		t.Fatal("host not found error expected, got", err)
+	}
+}
+
+func TestServiceServeConn(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.RLock()
+	h := s.hosts[echo1]
+	s.RUnlock()
+	current := func() (score float64) {
+		h.RLock()
+		score = h.timeSeries[h.timeSlot].score
+		h.RUnlock()
+		return
+	}
+
+	if err := s.ServeConn(context.Background(), func(*Conn) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if current() != HostUp {
+		t.Fatal("host scored up expected")
+	}
+
+	h.decay()
+	failure := errors.New("failure")
+	if err := s.ServeConn(context.Background(), func(*Conn) error { return failure }); err != failure {
+		t.Fatal("fn error expected, got", err)
+	}
+	if current() != HostUp { // nopDriver errors are temporary
+		t.Fatal("host scored up on temporary error expected")
+	}
+
+	h.decay()
+	err = s.ServeConnWithScore(context.Background(), func(*Conn) (float64, error) { return 0.25, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current() != 0.25 {
+		t.Fatal("explicit score expected, got", current())
+	}
+
+	h.decay()
+	err = s.ServeConnWithScore(context.Background(), func(*Conn) (float64, error) { return 2, failure })
+	if err != failure {
+		t.Fatal("fn error expected, got", err)
+	}
+	if current() != HostUp {
+		t.Fatal("bounded score expected, got", current())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.ServeConn(ctx, func(*Conn) error { return nil }); err != context.Canceled {
+		t.Fatal("context error expected, got", err)
+	}
+}
+
+func TestServiceServeConnFatal(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.RLock()
+	h := s.hosts[echo1]
+	s.RUnlock()
+
+	failure := errors.New("") // fake a fatal operation failure
+	if err := s.ServeConn(context.Background(), func(*Conn) error { return failure }); err != failure {
+		t.Fatal("fn error expected, got", err)
+	}
+	h.RLock()
+	score := h.timeSeries[h.timeSlot].score
+	h.RUnlock()
+	if score != HostDown {
+		t.Fatal("host scored down expected, got", score)
+	}
+}
+
+func TestServiceStatsdUnreachable(t *testing.T) {
+	var dials int32
+
+	defer func(d time.Duration) { statsdRetryDelay = d }(statsdRetryDelay)
+	defer func(f func(string, string) (statsd.Statter, error)) { newStatsdClient = f }(newStatsdClient)
+	statsdRetryDelay = 5 * time.Millisecond
+	newStatsdClient = func(addr, prefix string) (statsd.Statter, error) {
+		if atomic.AddInt32(&dials, 1) < 3 {
+			return nil, errors.New("statsd unreachable")
+		}
+		return statsd.NewClient(addr, prefix)
+	}
+
+	s, err := NewService("echo", &ServiceConfig{StatsdAddr: "127.0.0.1:8125"})
+	if err != nil {
+		t.Fatal("service creation expected despite statsd, got", err)
+	}
+	defer s.Close()
+
+	st := s.stats.(*statter)
+	if _, ok := st.get().(*statsd.Client); ok {
+		t.Fatal("no-op statter expected")
+	}
+	time.Sleep(50 * time.Millisecond) // wait for reconnection
+	if _, ok := st.get().(*statsd.Client); !ok {
+		t.Fatal("statsd client expected after reconnection")
+	}
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Fatal("3 dials expected, got", n)
+	}
+}
+
+func TestServiceLen(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	check := func(n int) {
+		time.Sleep(1 * time.Millisecond) // wait for propagation
+		if s.Len() != n || len(s.Status()) != n {
+			t.Fatal(n, "hosts expected, got", s.Len(), len(s.Status()))
+		}
+	}
+
+	check(0)
+	s.Add(echo1)
+	s.Add(echo2)
+	check(2)
+	s.Add(echo2)
+	check(2)
+	s.Remove(echo1)
+	check(1)
+	s.Add(echo3)
+	s.Remove(echo2)
+	s.Remove(echo3)
+	check(0)
+}
+
+func TestServiceRebind(t *testing.T) {
+	e1 := newEchoServer(t, echo1)
+	defer e1.close()
+	e2 := newEchoServer(t, echo2)
+	defer e2.close()
+
+	s, err := NewService("echo", &ServiceConfig{
+		PrespawnConns:  2,
+		BanditStrategy: NewEpsilonGreedy(0.1),
+		SessionStore:   NewInMemorySessionStore(),
+		TrackInFlight:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+
+	old, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := old.host
+	h.rate(0.8)
+	h.computeScore(nil)
+	score := h.Score()
+
+	sticky, err := s.GetConnWithStickinessKey("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sticky.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Rebind(echo1, echo2); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); len(st) != 1 || st[echo2] == 0 {
+		t.Fatal("host rebound expected:", st)
+	}
+	if h.pool.Address() != echo2 || h.Score() != score {
+		t.Fatal("score carried over expected")
+	}
+	if i := s.InFlight(); len(i) != 1 || i[0].ID != old.ID() || i[0].Address != echo2 {
+		t.Fatal("connection in flight reported under the new address expected:", i)
+	}
+
+	for i := 0; i < 3; i++ {
+		c, err := s.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.host != h || !strings.HasSuffix(c.NetConn().RemoteAddr().String(), ":7358") { // echo2
+			t.Fatal("connection to the new address expected")
+		}
+		if err := c.Release(nil, HostUp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The session remains bound to the host, on a connection to the new address
+	c, err := s.GetConnWithStickinessKey("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.host != h || !strings.HasSuffix(c.NetConn().RemoteAddr().String(), ":7358") {
+		t.Fatal("session bound to the rebound host expected")
+	}
+	id := c.ID()
+	if err := c.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = s.GetConnWithStickinessKey("session"); err != nil || c.ID() != id {
+		t.Fatal("session bound to the new connection expected:", err)
+	}
+	c.Release(nil, HostUp)
+
+	// Connections checked out before the rebind are renewed on release
+	events := h.pool.Events()
+	if err := old.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+	waitCollected(t, events, old)
+	if !old.isClosed() {
+		t.Fatal("connection to the old address closed expected")
+	}
+
+	if err := s.Rebind(echo1, echo2); err != ErrHostNotFound {
+		t.Fatal("host not found error expected")
+	}
+	s.AddSync(echo1)
+	if err := s.Rebind(echo1, echo2); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+	if err := s.Rebind(echo1, ""); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+}
+
+func TestServiceRebindUnlocked(t *testing.T) {
+	s, err := NewService("nop", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+	s.RLock()
+	p := s.hosts[echo1].pool
+	s.RUnlock()
+
+	// Hold the pool being rebound
+	observing, release := make(chan struct{}), make(chan struct{})
+	go p.ObserveConns(func([]*Conn) {
+		close(observing)
+		<-release
+	})
+	<-observing
+
+	done := make(chan error, 1)
+	go func() { done <- s.Rebind(echo1, echo3) }()
+	waitUntil(t, func() bool {
+		_, ok := s.Status()[echo3]
+		return ok
+	})
+	select {
+	case <-done:
+		t.Fatal("rebind held by the pool expected")
+	default:
+	}
+
+	// The service remains usable meanwhile
+	c, err := s.GetConnFrom(echo2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Release(nil, HostUp)
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if p.Address() != echo3 {
+		t.Fatal("pool rebound expected")
+	}
+}
+
+func TestServiceGetConnLeastScore(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:     PoolConfig{Driver: nopDriver{}},
+		BanditStrategy: NewEpsilonGreedy(0.1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+	s.AddSync(echo3)
+
+	c, err := s.GetConnLeastScore() // no score computed yet, fall back to GetConn
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Release(nil, HostUp)
+
+	s.RLock()
+	s.hosts[echo1].seed(0.9)
+	s.hosts[echo2].seed(HostDown)
+	s.hosts[echo3].seed(0.5)
+	s.hosts[echo3].invalidate()
+	s.RUnlock()
+
+	c, err = s.GetConnLeastScore() // invalidated score
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address() != echo3 {
+		t.Fatal(echo3, "expected, got", c.Address())
+	}
+	c.Release(nil, HostUp)
+
+	s.RLock()
+	s.hosts[echo3].seed(0.5)
+	s.RUnlock()
+
+	for i := 0; i < 10; i++ {
+		c, err := s.GetConnLeastScore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Address() != echo2 {
+			t.Fatal(echo2, "expected, got", c.Address())
+		}
+		if err := c.Release(nil, HostDown); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr, err := NewService("echo", &ServiceConfig{
+		PoolConfig:     PoolConfig{Driver: nopDriver{}},
+		BanditStrategy: NewRoundRobin(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+
+	rr.AddSync(echo1)
+	c, err = rr.GetConnLeastScore() // scores not computed, fall back to GetConn
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address() != echo1 {
+		t.Fatal(echo1, "expected, got", c.Address())
+	}
+	c.Release(nil, HostUp)
+}
+
+func TestServiceSetPrespawnConns(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}, MaxConns: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.SetPrespawnConns(3); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+	if err := s.SetPrespawnConns(0); err != nil {
+		t.Fatal(err)
+	}
+	s.AddSync(echo1)
+	time.Sleep(1 * time.Millisecond) // let connections be spawned, if any
+	if n := s.hosts[echo1].pool.ActiveConns(); n != 0 {
+		t.Fatal("no prespawned connection expected, got", n)
+	}
+}
+
+func TestServiceSetPrespawnConnsConcurrent(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}}, // MaxConns defaulted by the first host addition
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.AddSync(echo1)
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		if err := s.SetPrespawnConns(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestServiceSaturated(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}, MaxConns: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Saturated() {
+		t.Fatal("no saturation expected without host")
+	}
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+	time.Sleep(1 * time.Millisecond) // wait for connections to be spawned
+
+	c1, err := s.GetConnFrom(echo1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Saturated() {
+		t.Fatal("no saturation expected with an idle host")
+	}
+	c2, err := s.GetConnFrom(echo2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Saturated() {
+		t.Fatal("saturation expected")
+	}
+
+	if err := c1.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+	if s.Saturated() {
+		t.Fatal("no saturation expected after release")
+	}
+	c2.Release(nil, HostUp)
+}
+
+func TestServiceConnectionDistribution(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:    PoolConfig{Driver: nopDriver{}},
+		PrespawnConns: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if d := s.ConnectionDistribution(); len(d) != 0 {
+		t.Fatal("empty distribution expected:", d)
+	}
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+	s.RLock()
+	s.hosts[echo2].pool.New(2)
+	s.RUnlock()
+
+	d := s.ConnectionDistribution()
+	if math.Abs(d[echo1]-0.25) > 1e-9 || math.Abs(d[echo2]-0.75) > 1e-9 {
+		t.Fatal("bad distribution:", d)
+	}
+	var sum float64
+	for _, f := range d {
+		sum += f
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		t.Fatal("distribution summing to 1 expected, got", sum)
+	}
+}
+
+func TestServiceDialBudget(t *testing.T) {
+	gate, dialing := make(chan struct{}), make(chan struct{}, 2)
+	defer close(gate)
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: gatedDriver{address: echo1, gate: gate, dialing: dialing}},
+		DialBudget: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetPrespawnConns(0)
+	s.AddSync(echo1) // scheduled first by RoundRobin, its dials never complete until the gate opens
+	s.AddSync(echo2)
+
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-dialing:
+	default:
+		t.Fatal("dial to the slow host expected")
+	}
+	if c.Address() != echo2 {
+		t.Fatal(echo2, "expected, got", c.Address())
+	}
+	if n := s.Metrics().GetFails; n != 1 {
+		t.Fatal("slow host given up on expected, got", n, "failures")
+	}
+	c.Release(nil, HostUp)
+
+	// The dial is given up on past the budget, regardless of the wait timeout
+	s.SetGetAttempts(1)
+	if _, err := s.GetConnFrom(echo1); err == nil || !strings.Contains(err.Error(), ErrOpTimeout.Error()) {
+		t.Fatal("timeout error expected, got", err)
+	}
+	select {
+	case <-dialing:
+	default:
+		t.Fatal("dial to the slow host expected")
+	}
+}
+
+func TestServiceDialBudgetSaturated(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}, MaxConns: 1},
+		DialBudget: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.Release(nil, HostUp)
+	}()
+
+	// Waiting for the connection to be released isn't part of the budget
+	d, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != c {
+		t.Fatal("released connection expected")
+	}
+	d.Release(nil, HostUp)
+}
+
+func TestServiceGetConnMeasuredNotNetConn(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	if _, _, err := s.GetConnMeasured(); err != ErrNotNetConn {
+		t.Fatal("not a net.Conn error expected, got", err)
+	}
+	waitUntil(t, s.AllConnsIdle) // the connection released and the prespawned ones dialed
+	s.RLock()
+	h := s.hosts[echo1]
+	s.RUnlock()
+	h.computeScore(nil)
+	if score := h.Score(); score != DefaultNeutralScore {
+		t.Fatal("neutral score expected, got", score)
+	}
+}
+
+func TestServiceGetConnMeasured(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+
+	c, m, err := s.GetConnMeasured()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := ping(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.WriteCalls() != 3 || m.BytesWritten() != 3*4 {
+		t.Fatal("bad write counters:", m.WriteCalls(), m.BytesWritten())
+	}
+	if m.ReadCalls() != 3 || m.BytesRead() != 3*4 {
+		t.Fatal("bad read counters:", m.ReadCalls(), m.BytesRead())
+	}
+	if err := c.Release(nil, HostUp); err != nil {
+		t.Fatal(err)
+	}
+	if c.measured != nil {
+		t.Fatal("measured connection detached on release expected")
+	}
+}
+
+func TestServiceWaitForIdle(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+
+	c1, err := s.GetConnFrom(echo1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := s.GetConnFrom(echo2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		c1.Release(nil, HostUp)
+		time.Sleep(5 * time.Millisecond)
+		c2.Release(nil, HostUp)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.WaitForIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !s.AllConnsIdle() {
+		t.Fatal("all connections idle expected")
+	}
+}
+
+func TestServiceGetConnCancel(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}, MaxConns: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Release(nil, HostUp)
+
+	cancel := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(cancel)
+	}()
+
+	if _, err := s.GetConnCancel(cancel); err != ErrCanceled {
+		t.Fatal("canceled error expected, got", err)
+	}
+	select {
+	case <-cancel:
+	default:
+		t.Fatal("return upon cancellation expected")
+	}
+	if err := (cancelContext{context.Background(), cancel}).Err(); err != context.Canceled {
+		t.Fatal("context canceled error expected, got", err)
+	}
+}
+
+func TestServiceRemoveAll(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+
+	if err := s.RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	if m := s.Status(); len(m) != 0 {
+		t.Fatal("empty status expected, got", m)
+	}
+
+	// The service is still usable
+	s.AddSync(echo3)
+	if m := s.Status(); len(m) != 1 {
+		t.Fatal("one host expected, got", m)
+	}
+
+	s.Close()
+	if err := s.RemoveAll(); err != ErrPoolClosed {
+		t.Fatal("pool closed error expected, got", err)
+	}
+}
+
+type badBorrowDriver struct {
+	nopDriver
+	n int32
+}
+
+func (d *badBorrowDriver) TestOnBorrow(*Conn) error {
+	if atomic.AddInt32(&d.n, 1)%2 == 0 {
+		return errors.New("validation failed")
+	}
+	return nil
+}
+
+func (d *badBorrowDriver) Temporary(error) bool { return false }
+
+func TestServiceBadBorrowScore(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: &badBorrowDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+
+	for i := 0; i < 10; i++ {
+		c, err := s.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Release(nil, HostUp)
+	}
+
+	h := s.hosts[echo1]
+	h.computeScore(nil)
+	if score := h.Score(); score > 0.75 {
+		t.Fatal("degraded score expected, got", score)
+	}
+}
+
+func TestServiceGetConnAll(t *testing.T) {
+	e1 := newEchoServer(t, echo1)
+	defer e1.close()
+	e2 := newEchoServer(t, echo2)
+	defer e2.close()
+	e3 := newEchoServer(t, echo3)
+	defer e3.close()
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{WaitTimeout: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+	s.AddSync(echo3)
+
+	conns, err := s.GetConnAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 3 {
+		t.Fatal("three connections expected, got", len(conns))
+	}
+	ports := make(map[string]bool)
+	for _, c := range conns {
+		a := c.NetConn().RemoteAddr().String()
+		ports[a[strings.LastIndex(a, ":"):]] = true
+	}
+	if len(ports) != 3 {
+		t.Fatal("connections to distinct hosts expected")
+	}
+
+	m := []byte("ping")
+	if n, err := MultiConn(conns).WriteAll(m); err != nil || n != len(m) {
+		t.Fatal("write to all connections expected:", n, err)
+	}
+	for _, c := range conns {
+		b := make([]byte, len(m))
+		if _, err := io.ReadFull(c.NetConn(), b); err != nil || string(b) != "ping" {
+			t.Fatal("echo expected:", string(b), err)
+		}
+		c.Release(nil, HostUp)
+	}
+
+	// Acquisition fails altogether when a host is down
+	s.AddSync("localhost:7360")
+	if _, err := s.GetConnAll(); !errors.Is(err, ErrPartialAcquisition) {
+		t.Fatal("partial acquisition error expected, got", err)
+	}
+	if !s.AllConnsIdle() {
+		t.Fatal("acquired connections released expected")
+	}
+	for _, a := range []string{echo1, echo2, echo3} {
+		s.RLock()
+		h := s.hosts[a]
+		s.RUnlock()
+		h.RLock()
+		score := h.timeSeries[h.timeSlot].score
+		h.RUnlock()
+		if score >= HostUp {
+			t.Fatal("neutral feedback expected on", a, "got", score)
+		}
+	}
+}
+
+func TestServiceSetGetAttempts(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{GetAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.GetConn(); err != ErrNoHostAvailable {
+		t.Fatal("no host available error expected, got", err)
+	}
+	if n := s.Metrics().GetAttempts; n != 2 {
+		t.Fatal("2 attempts expected, got", n)
+	}
+
+	if err := s.SetGetAttempts(0); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+	if err := s.SetGetAttempts(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetConn(); err != ErrNoHostAvailable {
+		t.Fatal("no host available error expected, got", err)
+	}
+	if n := s.Metrics().GetAttempts; n != 2+5 {
+		t.Fatal("5 more attempts expected, got", n-2)
+	}
+}
+
+func TestServiceSetWaitTimeout(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:  PoolConfig{Driver: nopDriver{}, MaxConns: 1},
+		GetAttempts: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+
+	if err := s.SetWaitTimeout(-1); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+	if err := s.SetWaitTimeout(5 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Release(nil, HostUp)
+
+	if _, err := s.GetConn(); err == nil {
+		t.Fatal("wait timeout expected")
+	}
+}
+
+func TestServiceGetConnWithFilter(t *testing.T) {
+	tenants := map[string]string{
+		echo1: "foo",
+		echo2: "bar",
+		echo3: "foo",
+	}
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for a := range tenants {
+		s.AddSync(a)
+	}
+
+	for i := 0; i < 10; i++ {
+		c, err := s.GetConnWithFilter(func(h *Host) bool { return tenants[h.Address()] == "foo" })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tenants[c.Address()] != "foo" {
+			t.Fatal("host of tenant foo expected, got", c.Address())
+		}
+		c.Release(nil, HostUp)
+	}
+
+	if _, err := s.GetConnWithFilter(func(h *Host) bool { return tenants[h.Address()] == "baz" }); err != ErrNoHostAvailable {
+		t.Fatal("no host available error expected, got", err)
+	}
+	if _, err := s.GetConnWithFilter(nil); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected, got", err)
+	}
+}
+
+func TestServiceFailFastNoHost(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		GetAttempts:     5,
+		GetRetryBackoff: 10 * time.Millisecond,
+		FailFastNoHost:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A single attempt means no retry, hence no backoff wait
+	if _, err := s.GetConn(); err != ErrNoHostAvailable {
+		t.Fatal("no host available error expected, got", err)
+	}
+	if n := s.Metrics().GetAttempts; n != 1 {
+		t.Fatal("single attempt expected, got", n)
+	}
+
+	retried := make(chan struct{})
+	_, err = s.GetConnRetryPolicy(RetryPolicy{
+		MaxAttempts: 5,
+		Backoff:     10 * time.Millisecond,
+		ShouldRetry: func(error) bool { close(retried); return true },
+	})
+	if err != ErrNoHostAvailable {
+		t.Fatal("no host available error expected, got", err)
+	}
+	select {
+	case <-retried:
+		t.Fatal("no retry expected")
+	default:
+	}
+	if n := s.Metrics().GetAttempts; n != 2 {
+		t.Fatal("single attempt expected, got", n-1)
+	}
+}
+
+func TestServiceGetConnMatching(t *testing.T) {
+	regions := map[string]string{
+		echo1: "us-east",
+		echo2: "eu-west",
+		echo3: "us-east",
+	}
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for a, r := range regions {
+		s.AddTagged(a, map[string]string{"region": r, "role": "replica"})
+	}
+	for s.Len() != len(regions) {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	for i := 0; i < 10; i++ {
+		c, err := s.GetConnMatching(map[string]string{"region": "us-east", "role": "replica"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if regions[c.Address()] != "us-east" {
+			t.Fatal("host in us-east expected, got", c.Address())
+		}
+		c.Release(nil, HostUp)
+	}
+
+	if _, err := s.GetConnMatching(map[string]string{"region": "ap-south"}); err != ErrNoHostAvailable {
+		t.Fatal("no host available error expected, got", err)
+	}
+	if _, err := s.GetConnMatching(map[string]string{"region": "us-east", "role": "primary"}); err != ErrNoHostAvailable {
+		t.Fatal("no host available error expected, got", err)
+	}
+}
+
+func TestServiceGetConnRetryPolicy(t *testing.T) {
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	attempts := func(p RetryPolicy) (n uint64, d time.Duration) {
+		before := s.Metrics().GetAttempts
+		start := time.Now()
+		if _, err := s.GetConnRetryPolicy(p); err != ErrNoHostAvailable {
+			t.Fatal("no host available error expected, got", err)
+		}
+		return s.Metrics().GetAttempts - before, time.Since(start)
+	}
+
+	// MaxAttempts
+	if n, _ := attempts(RetryPolicy{}); n != 1 {
+		t.Fatal("single attempt expected, got", n)
+	}
+	if n, _ := attempts(RetryPolicy{MaxAttempts: 4}); n != 4 {
+		t.Fatal("4 attempts expected, got", n)
+	}
+
+	// Backoff
+	if n, d := attempts(RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond}); n != 3 || d < 20*time.Millisecond {
+		t.Fatal("constant backoff expected:", n, d)
+	}
+
+	// BackoffFactor
+	if n, d := attempts(RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond, BackoffFactor: 3}); n != 3 || d < 40*time.Millisecond {
+		t.Fatal("exponential backoff expected:", n, d)
+	}
+
+	// ShouldRetry
+	var errs []error
+	p := RetryPolicy{
+		MaxAttempts: 5,
+		ShouldRetry: func(err error) bool {
+			errs = append(errs, err)
+			return len(errs) < 2
+		},
+	}
+	if n, _ := attempts(p); n != 2 {
+		t.Fatal("2 attempts expected, got", n)
+	}
+	if len(errs) != 2 || errs[0] != ErrNoHostAvailable {
+		t.Fatal("retry decisions on no host available errors expected:", errs)
+	}
+}
+
+func TestServiceGetConnContextRetryPolicy(t *testing.T) {
+	s, err := NewService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = s.GetConnContextRetryPolicy(ctx, RetryPolicy{MaxAttempts: 100, Backoff: 10 * time.Millisecond})
+	if err != context.DeadlineExceeded {
+		t.Fatal("deadline exceeded expected, got", err)
+	}
+	if n := s.Metrics().GetAttempts; n >= 100 {
+		t.Fatal("retries interrupted by the context expected, got", n, "attempts")
+	}
+}
+
+func TestServiceReconfigureHost(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}, MaxConns: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+
+	old, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.hosts[echo1]
+	h.rate(0.2)
+	h.computeScore(nil)
+	score := h.Score()
+
+	if err := s.ReconfigureHost(echo2, &PoolConfig{Driver: nopDriver{}}); err != ErrHostNotFound {
+		t.Fatal("host not found error expected, got", err)
+	}
+	if err := s.ReconfigureHost(echo1, &PoolConfig{Driver: nopDriver{}, MaxConns: 5, WaitTimeout: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if s.hosts[echo1].Score() != score {
+		t.Fatal("score preserved expected")
+	}
+
+	// Feedback from connections of the old pool goes to the new host
+	n := s.hosts[echo1].Trials()
+	old.Release(nil, HostUp)
+	if s.hosts[echo1].Trials() != n+1 {
+		t.Fatal("release of a connection from the old pool recorded by the new host expected")
+	}
+
+	// New connections come from the new pool, with the new limit
+	var conns []*Conn
+	for i := 0; i < 5; i++ {
+		c, err := s.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	if _, err := s.GetConnFrom(echo1); err == nil {
+		t.Fatal("new MaxConns limit reached expected")
+	}
+	for _, c := range conns {
+		c.Release(nil, HostUp)
+	}
+
+	// The old pool drains now that its connection is released
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	for !h.pool.status.is(closed) {
+		if ctx.Err() != nil {
+			t.Fatal("old pool drained expected")
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+type recordLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) Printf(format string, v ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+func TestServiceForceRemoveAll(t *testing.T) {
+	for _, track := range []bool{true, false} {
+		l := &recordLogger{}
+		s, err := NewService("echo", &ServiceConfig{
+			PoolConfig:    PoolConfig{Driver: nopDriver{}},
+			TrackInFlight: track,
+			Logger:        l,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.SetPrespawnConns(0)
+		s.AddSync(echo1)
+		s.AddSync(echo2)
+
+		c, err := s.GetConnFrom(echo1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := s.GetConnFrom(echo2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Release(nil, HostUp) // idle
+		p1, p2 := s.hosts[echo1].pool, s.hosts[echo2].pool
+
+		s.ForceRemoveAll()
+		if m := s.Status(); len(m) != 0 {
+			t.Fatal("empty status expected, got", m)
+		}
+		if !p1.status.is(closed) || !p2.status.is(closed) {
+			t.Fatal("pools forcefully closed expected")
+		}
+		if _, err := s.GetConn(); err != ErrNoHostAvailable {
+			t.Fatal("no host available error expected, got", err)
+		}
+		if n := p1.ActiveConns(); n != 1 {
+			t.Fatal("abandoned connection only expected, got", n)
+		}
+		if n := p2.ActiveConns(); n != 0 && n != p2.MaxConns { // counters reaching zero while closing are set back to MaxConns
+			t.Fatal("no connection expected, got", n)
+		}
+
+		l.Lock()
+		if track && (len(l.lines) != 1 || !strings.Contains(l.lines[0], "WARNING") || !strings.Contains(l.lines[0], echo1)) {
+			t.Fatal("one warning for the abandoned connection expected:", l.lines)
+		}
+		if !track && len(l.lines) != 0 {
+			t.Fatal("no warning expected without TrackInFlight:", l.lines)
+		}
+		l.Unlock()
+		c.Release(nil, HostUp)
+		s.Close()
+	}
+}
+
+func TestServiceSelections(t *testing.T) {
+	hosts := []string{echo1, echo2, echo3}
+
+	run := func(strategy Selecter, n int, prepare func(*Service)) map[string]uint64 {
+		s, err := NewService("echo", &ServiceConfig{
+			PoolConfig:     PoolConfig{Driver: nopDriver{}},
+			BanditStrategy: strategy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		for _, a := range hosts {
+			s.AddSync(a)
+		}
+		if prepare != nil {
+			prepare(s)
+		}
+		for i := 0; i < n; i++ {
+			c, err := s.GetConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Release(nil, HostUp)
+		}
+		return s.Metrics().Selections
+	}
+
+	m := run(NewRoundRobin(), 30, nil)
+	for _, a := range hosts {
+		if m[a] != 10 {
+			t.Fatal("uniform distribution expected:", m)
+		}
+	}
+
+	m = run(NewEpsilonGreedy(0), 30, func(s *Service) {
+		s.hosts[echo1].rate(0.1)
+		s.hosts[echo2].rate(0.9)
+		s.hosts[echo3].rate(0.1)
+		for _, h := range s.hosts {
+			h.computeScore(nil)
+		}
+	})
+	if m[echo2] != 30 {
+		t.Fatal("selections concentrated on the best host expected:", m)
+	}
+}
+
+func TestServiceGetConnPreferred(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+	s.AddSync(echo3)
+
+	for i := 0; i < 3; i++ {
+		c, err := s.GetConnPreferred(echo2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Address() != echo2 {
+			t.Fatal("connection from the preferred host expected, got", c.Address())
+		}
+		c.Release(nil, HostUp)
+	}
+
+	s.Remove(echo2)
+	for s.Len() != 2 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	c, err := s.GetConnPreferred(echo2)
+	if err != nil {
+		t.Fatal("fallback expected, got", err)
+	}
+	if a := c.Address(); a != echo1 && a != echo3 {
+		t.Fatal("connection from another host expected, got", a)
+	}
+	c.Release(nil, HostUp)
+}
+
+func TestServiceAddSyncExisted(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	existed, err := s.AddSync(echo1)
+	if err != nil || existed {
+		t.Fatal("new host expected:", existed, err)
+	}
+	existed, err = s.AddSync(echo1)
+	if err != nil || !existed {
+		t.Fatal("host already existed expected:", existed, err)
+	}
+	if s.Len() != 1 {
+		t.Fatal("single host expected")
+	}
+}
+
+func TestServiceGetConnWithTimeout(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}, MaxConns: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+
+	if _, err := s.GetConnWithTimeout(50*time.Millisecond, echo3); err != ErrHostNotFound {
+		t.Fatal("host not found error expected, got", err)
+	}
+
+	// Preferred host available
+	c, err := s.GetConnWithTimeout(50*time.Millisecond, echo1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address() != echo1 {
+		t.Fatal("connection from the preferred host expected, got", c.Address())
+	}
+	defer c.Release(nil, HostUp)
+
+	// Preferred host exhausted, fallback to the other one
+	c2, err := s.GetConnWithTimeout(50*time.Millisecond, echo1)
+	if err != nil {
+		t.Fatal("fallback expected, got", err)
+	}
+	defer c2.Release(nil, HostUp)
+	if c2.Address() != echo2 {
+		t.Fatal("connection from the other host expected, got", c2.Address())
+	}
+
+	// Every host exhausted
+	if _, err := s.GetConnWithTimeout(50*time.Millisecond, echo1); err == nil {
+		t.Fatal("timeout error expected")
+	}
+}
+
+func TestServiceGetConnWithTimeoutFallback(t *testing.T) {
+	gate, dialing := make(chan struct{}), make(chan struct{})
+	defer close(gate)
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: gatedDriver{address: echo1, gate: gate, dialing: dialing}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetPrespawnConns(0)
+	s.AddSync(echo1) // the preferred host never serves until the gate opens
+	s.AddSync(echo2)
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := s.GetConnWithTimeout(200*time.Millisecond, echo1)
+		done <- result{c, err}
+	}()
+
+	// The preferred host is tried first, then the fallback is served within the remaining time
+	<-dialing
+	r := <-done
+	if r.err != nil {
+		t.Fatal("fallback within the timeout expected, got", r.err)
+	}
+	if r.conn.Address() != echo2 {
+		t.Fatal("connection from the other host expected, got", r.conn.Address())
+	}
+	r.conn.Release(nil, HostUp)
+}
+
+func TestConnReleaseWeighted(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+
+	release := func(a string, score float64, weight uint) {
+		c, err := s.GetConnFrom(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if weight == 1 {
+			err = c.Release(nil, score)
+		} else {
+			err = c.ReleaseWeighted(nil, score, weight)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	release(echo1, HostUp, 1)
+	release(echo1, HostDown, 1)
+	release(echo2, HostUp, 1)
+	release(echo2, HostDown, 10)
+
+	h1, h2 := s.hosts[echo1], s.hosts[echo2]
+	h1.computeScore(nil)
+	h2.computeScore(nil)
+	if h2.Score() >= h1.Score() {
+		t.Fatal("weighted release moving the score further expected:", h1.Score(), h2.Score())
+	}
+	if h2.Trials() != 11 {
+		t.Fatal("11 trials expected, got", h2.Trials())
+	}
+
+	c, err := s.GetConnFrom(echo1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReleaseWeighted(nil, HostUp, 0); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+	c.Release(nil, HostUp)
+
+	// Trials saturate instead of overflowing
+	release(echo1, HostDown, math.MaxUint32)
+	if n := h1.TrialsInSlot(0); n != math.MaxUint32 {
+		t.Fatal("saturated trials expected, got", n)
+	}
+	h1.computeScore(nil)
+	if score := h1.Score(); score < 0 || score > 1 {
+		t.Fatal("score within [0,1] expected, got", score)
+	}
+}
+
+func TestServiceGetConnExcluding(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:     PoolConfig{Driver: nopDriver{}},
+		BanditStrategy: NewEpsilonGreedy(0.5),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+
+	for i := 0; i < 100; i++ {
+		c, err := s.GetConnExcluding(echo2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Address() != echo1 {
+			t.Fatal("non excluded host expected, got", c.Address())
+		}
+		c.Release(nil, HostUp)
+	}
+
+	if _, err := s.GetConnExcluding(echo1, echo2); err != ErrNoHostAvailable {
+		t.Fatal("no host available error expected, got", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.GetConnContextExcluding(ctx, echo2); err != context.Canceled {
+		t.Fatal("context canceled error expected, got", err)
+	}
+}
+
+func TestServiceProbeRoundRobin(t *testing.T) {
+	if _, err := NewService("echo", &ServiceConfig{ProbeInterval: -1}); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:    PoolConfig{Driver: nopDriver{}},
+		ProbeInterval: 1 * time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+
+	// Scores are schedule slots, probes must not disrupt the rotation
+	var last string
+	for i := 0; i < 10; i++ {
+		c, err := s.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Address() == last {
+			t.Fatal("hosts selected in turn expected")
+		}
+		last = c.Address()
+		c.Release(nil, HostUp)
+	}
+}
+
+func TestServiceProbeZeroScore(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:     PoolConfig{Driver: nopDriver{}},
+		BanditStrategy: NewEpsilonGreedy(0), // never explore
+		ProbeInterval:  10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+
+	h1, h2 := s.hosts[echo1], s.hosts[echo2]
+	for i := 0; i < 10; i++ {
+		h1.rate(HostDown)
+		h2.rate(HostUp)
+	}
+	h1.computeScore(nil)
+	h2.computeScore(nil)
+	if h1.Score() != 0 {
+		t.Fatal("zero score expected")
+	}
+
+	// The host has recovered, it gets probed and selected again eventually
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for h1.Score() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("zero scored host probed expected")
+		}
+		c, err := s.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Release(nil, HostUp)
+		h1.computeScore(nil)
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestServiceResetHostScore(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	if err := s.ResetHostScore(echo2); err != ErrHostNotFound {
+		t.Fatal("host not found expected")
+	}
+
+	h := s.hosts[echo1]
+	for i := 0; i < 10; i++ {
+		h.rate(HostDown)
+	}
+	h.computeScore(nil)
+	if h.Score() != 0 {
+		t.Fatal("zero score expected")
+	}
+
+	if err := s.ResetHostScore(echo1); err != nil {
+		t.Fatal(err)
+	}
+	if h.Score() != -1 || h.Trials() != 0 {
+		t.Fatal("unknown score expected, got", h.Score(), h.Trials())
+	}
+	h.computeScore(nil)
+	if h.Score() != 0.5 {
+		t.Fatal("neutral score expected, got", h.Score())
+	}
+}
+
+func TestServiceHostScoreFloor(t *testing.T) {
+	if _, err := NewService("echo", &ServiceConfig{HostScoreFloor: -0.1}); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:     PoolConfig{Driver: nopDriver{}},
+		BanditStrategy: NewEpsilonGreedy(0),
+		HostScoreFloor: 0.05,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	h := s.hosts[echo1]
+	for i := 0; i < 10; i++ {
+		h.rate(0.01)
+	}
+	h.computeScore(nil)
+	if score := h.Score(); score != 0.05 {
+		t.Fatal("floor score expected, got", score)
+	}
+	if score := s.ExportScores()[echo1]; score != 0.05 {
+		t.Fatal("floor score exported expected, got", score)
+	}
+	if score := h.Stats().Score; math.Abs(score-0.01) > 1e-9 {
+		t.Fatal("actual score retained expected, got", score)
+	}
+
+	// Further feedback builds upon the actual score
+	h.rate(HostUp)
+	h.computeScore(nil)
+	if score := h.Score(); math.Abs(score-0.1) > 1e-9 {
+		t.Fatal("score of 0.1 expected, got", score)
+	}
+}
+
+func TestServiceOnSelect(t *testing.T) {
+	var selected []string
+	var scores []float64
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+		OnSelect: func(addr string, score float64) {
+			selected = append(selected, addr)
+			scores = append(scores, score)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+
+	for i := 0; i < 4; i++ {
+		c, err := s.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(selected) != i+1 || selected[i] != c.Address() {
+			t.Fatal("selection of", c.Address(), "reported expected, got", selected)
+		}
+		if scores[i] != -1 {
+			t.Fatal("unscored host reported expected with RoundRobin, got", scores[i])
+		}
+		c.Release(nil, HostUp)
+	}
+}
+
+func TestServiceOnSelectEarlySelections(t *testing.T) {
+	var selected []string
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:        PoolConfig{Driver: nopDriver{}},
+		CanaryHost:        echo3,
+		SelectionCacheTTL: 1 * time.Hour,
+		OnSelect: func(addr string, score float64) {
+			selected = append(selected, addr)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo3)
+
+	get := func(get func() (*Conn, error), addr string) {
+		n := len(selected)
+		c, err := get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(selected) != n+1 || selected[n] != addr || c.Address() != addr {
+			t.Fatal("selection of", addr, "reported expected, got", selected)
+		}
+		c.Release(nil, HostUp)
+	}
+	get(s.GetConn, echo1)
+	get(s.GetConn, echo1) // cached
+	get(func() (*Conn, error) { return s.GetConnProbabilistic(1) }, echo3)
+}
+
+func TestServiceGetConnProbabilistic(t *testing.T) {
+	const n = 10000
+
+	if _, err := NewService("echo", &ServiceConfig{CanaryProbability: 2}); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig: PoolConfig{Driver: nopDriver{}},
+		CanaryHost: echo3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+	if _, err := s.GetConnProbabilistic(0.1); err != ErrHostNotFound {
+		t.Fatal("host not found error expected")
+	}
+	s.AddSync(echo3)
+	if _, err := s.GetConnProbabilistic(1.5); err != ErrInvalidArg {
+		t.Fatal("invalid argument error expected")
+	}
+
+	get := func(get func() (*Conn, error)) (canary int) {
+		for i := 0; i < n; i++ {
+			c, err := get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Address() == echo3 {
+				canary++
+			}
+			c.Release(nil, HostUp)
+		}
+		return
+	}
+
+	if m := get(s.GetConn); m != 0 {
+		t.Fatal("canary host never selected by GetConn expected, got", m)
+	}
+	if m := get(func() (*Conn, error) { return s.GetConnProbabilistic(0.2) }); m < n*0.17 || m > n*0.23 {
+		t.Fatal("canary host selected 20% of the time expected, got", m)
+	}
+}
+
+func TestServiceCanarySelectionCache(t *testing.T) {
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:        PoolConfig{Driver: nopDriver{}},
+		CanaryHost:        echo3,
+		SelectionCacheTTL: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The canary alone is never selected by the BanditStrategy
+	s.AddSync(echo3)
+	if _, err := s.GetConn(); err != ErrNoHostAvailable {
+		t.Fatal("no host available error expected")
+	}
+
+	// The selection cache remains effective with a canary
+	s.AddSync(echo1)
+	s.AddSync(echo2)
+	var last string
+	for i := 0; i < 10; i++ {
+		c, err := s.GetConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := c.Address(); a == echo3 || (last != "" && a != last) {
+			t.Fatal("cached host selection expected, got", a)
+		}
+		last = c.Address()
+		c.Release(nil, HostUp)
+	}
+}
+
+func TestServiceApplyContextDeadline(t *testing.T) {
+	e := newEchoServer(t, echo1)
+	defer e.close()
+
+	s, err := NewService("echo", &ServiceConfig{
+		PoolConfig:           PoolConfig{Driver: testDriver, MaxConns: 1},
+		ApplyContextDeadline: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.AddSync(echo1)
+
+	getters := map[string]func(context.Context) (*Conn, error){
+		"GetConnContext": s.GetConnContext,
+		"GetConnContextRetryPolicy": func(ctx context.Context) (*Conn, error) {
+			return s.GetConnContextRetryPolicy(ctx, RetryPolicy{})
+		},
+		"GetConnContextExcluding": func(ctx context.Context) (*Conn, error) {
+			return s.GetConnContextExcluding(ctx, echo2)
+		},
+	}
+	for name, get := range getters {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		c, err := get(ctx)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		start := time.Now()
+		_, err = c.Read(make([]byte, 1)) // nothing to read
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			t.Fatal(name, "timeout error expected, got", err)
+		}
+		if d := time.Since(start); d > 1*time.Second {
+			t.Fatal(name, "read governed by the context deadline expected, took", d)
+		}
+		c.Release(nil, HostUp)
+		cancel()
+	}
+
+	// The deadline is cleared on release
+	c, err := s.GetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(c.NetConn()); err != nil {
+		t.Fatal(err)
+	}
+	c.Release(nil, HostUp)
+
+	// The acquisition timeout doesn't govern the I/O
+	c, err = s.GetConnTimeout(20 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond) // past the timeout
+	if err := ping(c.NetConn()); err != nil {
+		t.Fatal(err)
+	}
+	c.Release(nil, HostUp)
+}
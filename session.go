@@ -0,0 +1,48 @@
+package pooly
+
+import "sync"
+
+// SessionStore describes the interface responsible of binding session keys to connections (see Service.GetConnWithStickinessKey).
+type SessionStore interface {
+	// Set binds a given key to a connection ID.
+	Set(key string, connID uint64)
+
+	// Get returns the connection ID bound to a given key, if any.
+	Get(key string) (uint64, bool)
+
+	// Delete unbinds a given key.
+	Delete(key string)
+}
+
+// InMemorySessionStore is a SessionStore keeping sessions in memory, safe for concurrent use.
+type InMemorySessionStore struct {
+	sync.RWMutex
+	sessions map[string]uint64
+}
+
+// NewInMemorySessionStore creates a new in-memory session store.
+func NewInMemorySessionStore() *InMemorySessionStore {
+	return &InMemorySessionStore{sessions: make(map[string]uint64)}
+}
+
+// Set implements the SessionStore interface.
+func (s *InMemorySessionStore) Set(key string, connID uint64) {
+	s.Lock()
+	s.sessions[key] = connID
+	s.Unlock()
+}
+
+// Get implements the SessionStore interface.
+func (s *InMemorySessionStore) Get(key string) (id uint64, ok bool) {
+	s.RLock()
+	id, ok = s.sessions[key]
+	s.RUnlock()
+	return
+}
+
+// Delete implements the SessionStore interface.
+func (s *InMemorySessionStore) Delete(key string) {
+	s.Lock()
+	delete(s.sessions, key)
+	s.Unlock()
+}
@@ -0,0 +1,85 @@
+package pooly
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type simHost struct {
+	successRate float64
+	latency     time.Duration
+}
+
+// SimDriver is a driver simulating hosts for benchmarking purposes, no actual connection is ever established.
+// Every host is modeled as a Bernoulli process: each operation takes a fixed latency and succeeds with a given rate.
+// Outcomes are drawn from a random source private to the driver, simulations are thus reproducible given its seed.
+type SimDriver struct {
+	sync.RWMutex
+	defaults simHost
+	hosts    map[string]simHost
+	rand     *rand.Rand // guarded by the mutex
+}
+
+// SimConn is a simulated connection created by a SimDriver (see Conn.Interface).
+type SimConn struct {
+	simHost
+	driver *SimDriver
+}
+
+// NewSimDriver instantiates a new SimDriver, ready to be used in a PoolConfig.
+// The success rate (0-1) and the latency given apply to all the hosts unless specified otherwise (see SetHost).
+// Drivers created with the same seed simulate the same sequence of outcomes.
+func NewSimDriver(successRate float64, latency time.Duration, seed int64) *SimDriver {
+	return &SimDriver{
+		defaults: simHost{successRate, latency},
+		hosts:    make(map[string]simHost),
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetHost sets the success rate and the latency of a given host.
+func (d *SimDriver) SetHost(address string, successRate float64, latency time.Duration) {
+	d.Lock()
+	d.hosts[address] = simHost{successRate, latency}
+	d.Unlock()
+}
+
+// Dial creates a simulated connection to the given host.
+func (d *SimDriver) Dial(address string) (*Conn, error) {
+	d.RLock()
+	h, ok := d.hosts[address]
+	d.RUnlock()
+	if !ok {
+		h = d.defaults
+	}
+	return NewConn(&SimConn{h, d}), nil
+}
+
+// Close does nothing.
+func (d *SimDriver) Close(c *Conn) {}
+
+// TestOnBorrow does nothing.
+func (d *SimDriver) TestOnBorrow(c *Conn) error {
+	return nil
+}
+
+// Temporary always returns true, simulated failures never affect connections.
+func (d *SimDriver) Temporary(err error) bool {
+	return true
+}
+
+// Trial simulates an operation on the connection.
+// It returns a score suitable for Conn.Release (HostUp on success, HostDown otherwise).
+func (c *SimConn) Trial() float64 {
+	if c.latency > 0 {
+		time.Sleep(c.latency)
+	}
+	c.driver.Lock()
+	p := c.driver.rand.Float64()
+	c.driver.Unlock()
+	if p < c.successRate {
+		return HostUp
+	}
+	return HostDown
+}
@@ -0,0 +1,96 @@
+package pooly
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSimDriver(t *testing.T) {
+	const n = 10000
+
+	var sum float64
+
+	d := NewSimDriver(0.9, 0, 1)
+	d.SetHost(echo2, 0.1, 1*time.Millisecond)
+
+	c, _ := d.Dial(echo1)
+	for i := 0; i < n; i++ {
+		sum += c.Interface().(*SimConn).Trial()
+	}
+	if r := sum / n; math.Abs(r-0.9) > 0.02 {
+		t.Fatal("success rate of 0.9 expected, got", r)
+	}
+
+	c, _ = d.Dial(echo2)
+	start := time.Now()
+	c.Interface().(*SimConn).Trial()
+	if time.Since(start) < 1*time.Millisecond {
+		t.Fatal("simulated latency expected")
+	}
+}
+
+func TestSimDriverSeed(t *testing.T) {
+	d1, d2 := NewSimDriver(0.5, 0, 42), NewSimDriver(0.5, 0, 42)
+	c1, _ := d1.Dial(echo1)
+	c2, _ := d2.Dial(echo1)
+
+	var diff bool
+	for i := 0; i < 100; i++ {
+		s1, s2 := c1.Interface().(*SimConn).Trial(), c2.Interface().(*SimConn).Trial()
+		if s1 != s2 {
+			t.Fatal("same outcomes expected with the same seed, trial", i)
+		}
+		diff = diff || s1 != HostUp
+	}
+	if !diff {
+		t.Fatal("random outcomes expected")
+	}
+}
+
+func benchmarkSimStrategy(b *testing.B, strategy Selecter) {
+	var sum float64
+
+	d := NewSimDriver(0.9, 0, 1)
+	d.SetHost(echo2, 0.5, 0)
+	d.SetHost(echo3, 0.1, 0)
+
+	s, err := NewService("sim", &ServiceConfig{
+		PoolConfig:           PoolConfig{Driver: d},
+		MemoizeScoreDuration: 1 * time.Millisecond,
+		BanditStrategy:       strategy,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Add(echo1)
+	s.Add(echo2)
+	s.Add(echo3)
+	time.Sleep(1 * time.Millisecond) // wait for propagation
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := s.GetConn()
+		if err != nil {
+			b.Fatal(err)
+		}
+		score := c.Interface().(*SimConn).Trial()
+		sum += score
+		c.Release(nil, score)
+	}
+	b.ReportMetric(sum/float64(b.N), "success/op")
+}
+
+func BenchmarkSimRoundRobin(b *testing.B) {
+	benchmarkSimStrategy(b, NewRoundRobin())
+}
+
+func BenchmarkSimEpsilonGreedy(b *testing.B) {
+	benchmarkSimStrategy(b, NewEpsilonGreedy(0.1))
+}
+
+func BenchmarkSimSoftMax(b *testing.B) {
+	benchmarkSimStrategy(b, NewSoftMax(0.1))
+}
@@ -0,0 +1,53 @@
+package pooly
+
+import (
+	"github.com/cactus/go-statsd-client/statsd"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Escapes the statsd separators of a given metric name component (e.g. a host address).
+var statsdKey = strings.NewReplacer(".", "_", ":", "_").Replace
+
+// Delay between two attempts to connect to the statsd server.
+var statsdRetryDelay = 5 * time.Second
+
+// Creates a new statsd client, it is overridable for testing purposes.
+var newStatsdClient = statsd.NewClient
+
+type statterBox struct{ statsd.Statter }
+
+// Statsd client which can be replaced while in use (e.g. once the statsd server becomes reachable).
+type statter struct {
+	v atomic.Value
+}
+
+func newStatter(s statsd.Statter) *statter {
+	st := new(statter)
+	st.set(s)
+	return st
+}
+
+func (s *statter) set(st statsd.Statter) {
+	s.v.Store(statterBox{st})
+}
+
+func (s *statter) get() statsd.Statter {
+	return s.v.Load().(statterBox).Statter
+}
+
+func (s *statter) Inc(n string, v int64, r float32) error        { return s.get().Inc(n, v, r) }
+func (s *statter) Dec(n string, v int64, r float32) error        { return s.get().Dec(n, v, r) }
+func (s *statter) Gauge(n string, v int64, r float32) error      { return s.get().Gauge(n, v, r) }
+func (s *statter) GaugeDelta(n string, v int64, r float32) error { return s.get().GaugeDelta(n, v, r) }
+func (s *statter) Timing(n string, v int64, r float32) error     { return s.get().Timing(n, v, r) }
+func (s *statter) TimingDuration(n string, v time.Duration, r float32) error {
+	return s.get().TimingDuration(n, v, r)
+}
+func (s *statter) Set(n string, v string, r float32) error   { return s.get().Set(n, v, r) }
+func (s *statter) SetInt(n string, v int64, r float32) error { return s.get().SetInt(n, v, r) }
+func (s *statter) Raw(n string, v string, r float32) error   { return s.get().Raw(n, v, r) }
+func (s *statter) NewSubStatter(p string) statsd.SubStatter  { return s.get().NewSubStatter(p) }
+func (s *statter) SetPrefix(p string)                        { s.get().SetPrefix(p) }
+func (s *statter) Close() error                              { return s.get().Close() }
@@ -0,0 +1,9 @@
+package pooly
+
+// Converts abstract socket names to their canonical form (e.g. "@name" becomes "\x00name").
+func unixAddress(address string) string {
+	if len(address) > 0 && address[0] == '@' {
+		return "\x00" + address[1:]
+	}
+	return address
+}
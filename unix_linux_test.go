@@ -0,0 +1,44 @@
+package pooly
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestUnixDriverAbstract(t *testing.T) {
+	if unixAddress("@pooly") != "\x00pooly" || unixAddress("/tmp/pooly") != "/tmp/pooly" {
+		t.Fatal("abstract socket name conversion expected")
+	}
+
+	l, err := net.Listen("unix", "\x00pooly-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	p := NewPool("@pooly-test", &PoolConfig{
+		Driver: NewUnixDriver(),
+	})
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(c.NetConn()); err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c, nil)
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package pooly
+
+// The abstract socket namespace is specific to Linux.
+func unixAddress(address string) string {
+	return address
+}
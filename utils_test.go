@@ -27,6 +27,52 @@ const (
 
 var testDriver = &customDriver{NewNetDriver("tcp")}
 
+// nopDriver spawns connections without any underlying network activity.
+type nopDriver struct{}
+
+func (nopDriver) Dial(string) (*Conn, error) { return NewConn(nil), nil }
+func (nopDriver) Close(*Conn)                {}
+func (nopDriver) TestOnBorrow(*Conn) error   { return nil }
+func (nopDriver) Temporary(error) bool       { return true }
+
+func newTestHost(p *Pool) *Host {
+	return &Host{
+		pool:       p,
+		timeSeries: make([]serie, 1, seriesNum),
+		score:      -1,
+		neutral:    DefaultNeutralScore,
+		stats:      p.stats,
+		quit:       make(chan struct{}),
+	}
+}
+
+// Polls a given condition until it holds, failing the test if it doesn't within a few seconds.
+func waitUntil(t testing.TB, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+// Waits for a given connection to be garbage collected, as reported by the events of its pool (see Pool.Events).
+func waitCollected(t testing.TB, events <-chan PoolEvent, c *Conn) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == ConnClosed && e.Conn == c {
+				return
+			}
+		case <-timeout:
+			t.Fatal("connection not collected in time")
+		}
+	}
+}
+
 type bernouilliExperiment float32
 
 func (b bernouilliExperiment) trial() float64 {
@@ -42,7 +88,7 @@ type echoServer struct {
 	w sync.WaitGroup
 }
 
-func newEchoServer(t *testing.T, a string) *echoServer {
+func newEchoServer(t testing.TB, a string) *echoServer {
 	var err error
 
 	s := &echoServer{q: make(chan struct{})}
@@ -32,24 +32,88 @@ type releaseWrapper struct {
 
 	conn    *Conn
 	lasterr atomic.Value
+	ops     uint32
+	fails   uint32
 }
 
 func (w *releaseWrapper) Read(b []byte) (n int, err error) {
 	n, err = w.Conn.Read(b)
-	if err != nil {
-		w.lasterr.Store(&err)
-	}
+	w.record(err)
 	return
 }
 
 func (w *releaseWrapper) Write(b []byte) (n int, err error) {
 	n, err = w.Conn.Write(b)
+	w.record(err)
+	return
+}
+
+func (w *releaseWrapper) record(err error) {
+	atomic.AddUint32(&w.ops, 1)
 	if err != nil {
+		atomic.AddUint32(&w.fails, 1)
 		w.lasterr.Store(&err)
 	}
-	return
+}
+
+// Score the host proportionally to the I/O operations which succeeded.
+func (w *releaseWrapper) score() float64 {
+	ops := atomic.LoadUint32(&w.ops)
+	if ops == 0 {
+		return HostUp
+	}
+	return 1 - float64(atomic.LoadUint32(&w.fails))/float64(ops)
 }
 
 func (w *releaseWrapper) Close() error {
-	return w.conn.Release(w.lasterr.Load(), HostUp)
+	err := w.lasterr.Load()
+	if err == nil {
+		return w.conn.Release(nil, HostUp)
+	}
+	return w.conn.Release(err, w.score())
+}
+
+// MeasuredConn wraps a net.Conn and counts the bytes and calls going through it (see Service.GetConnMeasured).
+// It is safe to read the counters while the connection is in use.
+type MeasuredConn struct {
+	net.Conn
+
+	bytesRead    uint64
+	bytesWritten uint64
+	readCalls    uint64
+	writeCalls   uint64
+}
+
+func (m *MeasuredConn) Read(b []byte) (n int, err error) {
+	n, err = m.Conn.Read(b)
+	atomic.AddUint64(&m.bytesRead, uint64(n))
+	atomic.AddUint64(&m.readCalls, 1)
+	return
+}
+
+func (m *MeasuredConn) Write(b []byte) (n int, err error) {
+	n, err = m.Conn.Write(b)
+	atomic.AddUint64(&m.bytesWritten, uint64(n))
+	atomic.AddUint64(&m.writeCalls, 1)
+	return
+}
+
+// BytesRead returns the number of bytes read from the connection.
+func (m *MeasuredConn) BytesRead() uint64 {
+	return atomic.LoadUint64(&m.bytesRead)
+}
+
+// BytesWritten returns the number of bytes written to the connection.
+func (m *MeasuredConn) BytesWritten() uint64 {
+	return atomic.LoadUint64(&m.bytesWritten)
+}
+
+// ReadCalls returns the number of calls to Read.
+func (m *MeasuredConn) ReadCalls() uint64 {
+	return atomic.LoadUint64(&m.readCalls)
+}
+
+// WriteCalls returns the number of calls to Write.
+func (m *MeasuredConn) WriteCalls() uint64 {
+	return atomic.LoadUint64(&m.writeCalls)
 }